@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"github.com/EricBurnett/WebCmd/staticcontent"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var compress_responses = flag.Bool("compress_responses", true,
+	"Gzip pages and compressible files for clients that accept it. Brotli "+
+		"isn't supported.")
+var thumbnail_max_age = flag.Duration("thumbnail_max_age", 24*time.Hour,
+	"How long browsers may cache thumbnails and seek-bar previews without "+
+		"checking back.")
+
+// Largest page buffered to compute its ETag; larger ones are streamed
+// without one.
+var MAX_ETAG_BUFFER = 8 << 20
+
+// Responses smaller than this aren't worth compressing.
+var MIN_COMPRESS_SIZE = 1024
+
+// Suffix marking the ETag of a gzipped response, as it differs from the
+// uncompressed one.
+var GZIP_ETAG_SUFFIX = "-gzip"
+
+// Media types worth compressing, besides text/*.
+var compressibleTypes = map[string]bool{
+	"application/json": true, "application/javascript": true,
+	"application/xml": true, "image/svg+xml": true,
+}
+
+// Whether responses of contentType are worth compressing.
+func compressible(contentType string) bool {
+	t, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return strings.HasPrefix(t, "text/") || compressibleTypes[t] ||
+		strings.HasSuffix(t, "+xml") || strings.HasSuffix(t, "+json")
+}
+
+// Returns the Cache-Control policy for responses to r, or "" if they should
+// be left alone. Pages and listings are revalidated on every use (cheaply,
+// via their ETags), thumbnails kept for --thumbnail_max_age, files
+// revalidated, and streams (transcodes, archives) and playlists, which may
+// hold share tokens, never stored.
+func cachePolicy(r *http.Request) string {
+	p := r.URL.Path
+	switch {
+	case strings.HasPrefix(p, staticcontent.DAV_PREFIX+"/"):
+		return ""
+	case strings.HasPrefix(p, STATIC_PREFIX+"/"):
+		switch r.URL.Query().Get(staticcontent.PARAM_MODE) {
+		case staticcontent.MODE_THUMBNAIL, staticcontent.MODE_TRICKPLAY, staticcontent.MODE_SPRITE:
+			return "private, max-age=" + strconv.Itoa(int(thumbnail_max_age.Seconds()))
+		case staticcontent.MODE_TRANSCODE, staticcontent.MODE_REMUX,
+			staticcontent.MODE_SUBTITLES, staticcontent.MODE_ZIP, staticcontent.MODE_TAR,
+			staticcontent.MODE_M3U, staticcontent.MODE_XSPF:
+			return "no-store"
+		}
+		return "private, no-cache"
+	}
+	return "no-cache"
+}
+
+// Returns the ETag of the gzipped variant of a response with the given ETag.
+func gzipETag(etag string) string {
+	return strings.TrimSuffix(etag, `"`) + GZIP_ETAG_SUFFIX + `"`
+}
+
+// Whether an If-None-Match header matches etag.
+func etagMatches(ifNoneMatch string, etag string) bool {
+	for _, tag := range strings.Split(ifNoneMatch, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// Wraps h, adding Cache-Control headers per cachePolicy, ETags to pages that
+// don't have one, handling of If-None-Match for them, and gzip compression.
+// Only GET and HEAD requests are touched.
+func CachingHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		policy := cachePolicy(r)
+		if (r.Method != "GET" && r.Method != "HEAD") || len(policy) == 0 {
+			h.ServeHTTP(w, r)
+			return
+		}
+		c := &cachingWriter{ResponseWriter: w, r: r, policy: policy,
+			gzipOk: *compress_responses && acceptsGzip(r)}
+		// Handlers know their responses by their uncompressed ETags.
+		if inm := r.Header.Get("If-None-Match"); strings.Contains(inm, GZIP_ETAG_SUFFIX+`"`) {
+			c.gzipTagged = true
+			r.Header.Set("If-None-Match", strings.Replace(inm, GZIP_ETAG_SUFFIX+`"`, `"`, -1))
+		}
+		h.ServeHTTP(c, r)
+		c.finish()
+	})
+}
+
+// Whether r accepts gzipped responses.
+func acceptsGzip(r *http.Request) bool {
+	for _, coding := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		parts := strings.Split(coding, ";")
+		if strings.TrimSpace(parts[0]) == "gzip" {
+			return len(parts) == 1 || strings.Replace(parts[1], " ", "", -1) != "q=0"
+		}
+	}
+	return false
+}
+
+// A ResponseWriter applying CachingHandler's headers and compression. Pages
+// without an ETag are buffered so one can be computed from their contents.
+type cachingWriter struct {
+	http.ResponseWriter
+	r          *http.Request
+	policy     string
+	gzipOk     bool          // Whether the client accepts gzip
+	gzipTagged bool          // Whether the client sent gzipped ETags
+	started    bool          // Whether the handler has started the response
+	sent       bool          // Whether the response has been started on the wire
+	code       int           // Status code from the handler
+	buffer     *bytes.Buffer // The page so far, while buffering
+	gz         *gzip.Writer  // Compressor, if compressing
+}
+
+func (c *cachingWriter) WriteHeader(code int) {
+	if c.started {
+		return
+	}
+	c.started = true
+	c.code = code
+	h := c.Header()
+	if len(h.Get("Cache-Control")) == 0 {
+		if code >= http.StatusBadRequest {
+			// Errors may be fixed any moment.
+			h.Set("Cache-Control", "no-store")
+		} else {
+			h.Set("Cache-Control", c.policy)
+		}
+	}
+	if code == http.StatusOK && len(h.Get("ETag")) == 0 && c.policy != "no-store" &&
+		compressible(h.Get("Content-Type")) && len(h.Get("Content-Range")) == 0 {
+		c.buffer = new(bytes.Buffer)
+		return
+	}
+	c.send()
+}
+
+// Starts the response on the wire, compressing it if worthwhile.
+func (c *cachingWriter) send() {
+	c.sent = true
+	h := c.Header()
+	etag := h.Get("ETag")
+	if c.code == http.StatusNotModified {
+		h.Add("Vary", "Accept-Encoding")
+		if c.gzipTagged && len(etag) > 0 {
+			h.Set("ETag", gzipETag(etag))
+		}
+	}
+	if c.code == http.StatusOK && compressible(h.Get("Content-Type")) {
+		h.Add("Vary", "Accept-Encoding")
+		size, err := strconv.Atoi(h.Get("Content-Length"))
+		if c.gzipOk && len(h.Get("Content-Encoding")) == 0 &&
+			len(c.r.Header.Get("Range")) == 0 && (err != nil || size >= MIN_COMPRESS_SIZE) {
+			h.Del("Content-Length")
+			h.Set("Content-Encoding", "gzip")
+			if len(etag) > 0 {
+				h.Set("ETag", gzipETag(etag))
+			}
+			c.gz = gzip.NewWriter(c.ResponseWriter)
+		}
+	}
+	c.ResponseWriter.WriteHeader(c.code)
+}
+
+func (c *cachingWriter) Write(b []byte) (int, error) {
+	if !c.started {
+		if len(c.Header().Get("Content-Type")) == 0 {
+			c.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		c.WriteHeader(http.StatusOK)
+	}
+	if c.buffer != nil {
+		if c.buffer.Len()+len(b) <= MAX_ETAG_BUFFER {
+			return c.buffer.Write(b)
+		}
+		c.flushBuffer()
+	}
+	if c.gz != nil {
+		return c.gz.Write(b)
+	}
+	return c.ResponseWriter.Write(b)
+}
+
+// Stops buffering, sending what's buffered so far.
+func (c *cachingWriter) flushBuffer() {
+	buffered := c.buffer
+	c.buffer = nil
+	c.send()
+	c.Write(buffered.Bytes())
+}
+
+// Sends anything still buffered and ends the response. If the whole page was
+// buffered, it gets an ETag, and the client a 304 if it already has it.
+func (c *cachingWriter) finish() {
+	if !c.started {
+		c.WriteHeader(http.StatusOK)
+	}
+	if c.buffer != nil {
+		sum := sha256.Sum256(c.buffer.Bytes())
+		etag := fmt.Sprintf(`"%x"`, sum[:16])
+		c.Header().Set("ETag", etag)
+		if etagMatches(c.r.Header.Get("If-None-Match"), etag) {
+			c.buffer = nil
+			c.code = http.StatusNotModified
+			c.Header().Del("Content-Type")
+			c.Header().Del("Content-Length")
+			c.send()
+			return
+		}
+		if c.buffer.Len() < MIN_COMPRESS_SIZE {
+			c.Header().Set("Content-Length", strconv.Itoa(c.buffer.Len()))
+		}
+		c.flushBuffer()
+	}
+	if !c.sent {
+		c.send()
+	}
+	if c.gz != nil {
+		c.gz.Close()
+	}
+}
+
+// Sends what's been written so far to the client.
+func (c *cachingWriter) Flush() {
+	if c.buffer != nil {
+		c.flushBuffer()
+	}
+	if c.gz != nil {
+		c.gz.Flush()
+	}
+	if flusher, ok := c.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
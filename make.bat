@@ -1,3 +1,3 @@
 mkdir ..\..\..\..\bin
-call go build -o WebCmd.exe -ldflags="-Hwindowsgui" main.go server.go modulelist.go
+call go build -o WebCmd.exe -ldflags="-Hwindowsgui" .
 copy WebCmd.exe ..\..\..\..\bin\WebCmd.exe
\ No newline at end of file
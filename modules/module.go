@@ -35,6 +35,14 @@ type Module interface {
 	RunEvent(*http.Request) (template.HTML, error)
 }
 
+// Implemented by modules some of whose commands change things, like files.
+// Those are only run when POSTed from WebCmd's own pages, so other sites
+// can't trigger them with a link or form.
+type Mutator interface {
+	// Whether running the command string (as for RunCommand) changes things.
+	Mutates(command string, args string) bool
+}
+
 // Returns instances of all the modules available. Returned modules are
 // initialized already, and any that failed to init have been filtered out.
 func InstalledModules(ss *staticcontent.Server) []Module {
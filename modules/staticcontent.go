@@ -1,10 +1,14 @@
 package modules
 
 import (
+	"errors"
 	"github.com/EricBurnett/WebCmd/resources"
 	"github.com/EricBurnett/WebCmd/staticcontent"
 	"html/template"
 	"net/http"
+	"path"
+	"strings"
+	"time"
 )
 
 // StaticContentModule implements modules.Module and provides a listing of all
@@ -36,18 +40,196 @@ func (m *StaticContentModule) Commands() []string {
 	return []string{"static", "files"}
 }
 
-// RunCommand runs a single command. This module always just prints a listing
-// of mapped paths.
+// RunCommand runs a single command. "search <terms>" searches the names of
+// files in all mapped paths, and "find-text <terms>" their contents. "mkdir",
+// "rename", "move", "delete", "trash" and "restore" manage files in writable
+// roots (see FileOp), and "share", "shares" and "unshare" share links (see
+// Share); anything else prints a listing of the mapped paths.
 func (m *StaticContentModule) RunCommand(command string, args string) (template.HTML, error) {
+	subcommand := strings.SplitN(strings.TrimSpace(args), " ", 2)
+	if len(subcommand) == 1 {
+		subcommand = append(subcommand, "")
+	}
+	switch subcommand[0] {
+	case "search":
+		return m.Search(subcommand[1])
+	case "find-text":
+		return m.FindText(subcommand[1])
+	case "trash":
+		return m.Trash(strings.TrimSpace(subcommand[1]))
+	case "mkdir", "rename", "move", "delete", "restore":
+		return m.FileOp(subcommand[0], splitArgs(subcommand[1]))
+	case "share", "unshare":
+		return m.Share(subcommand[0], splitArgs(subcommand[1]))
+	case "shares":
+		return m.Shares()
+	}
 	return m.List()
 }
 
-// RunEvent responds to module events.  This module always just prints a listing
-// of mapped paths.
+// Mutates reports whether the command changes files or shares, per
+// Mutator.
+func (m *StaticContentModule) Mutates(command string, args string) bool {
+	switch strings.SplitN(strings.TrimSpace(args), " ", 2)[0] {
+	case "mkdir", "rename", "move", "delete", "restore", "share", "unshare":
+		return true
+	}
+	return false
+}
+
+// RunEvent responds to module events by re-running the query the page was
+// produced for, if any. Only queries that don't change files are re-run.
 func (m *StaticContentModule) RunEvent(req *http.Request) (template.HTML, error) {
+	query := strings.SplitN(strings.TrimSpace(req.FormValue("q")), " ", 2)
+	if len(query) == 2 {
+		subcommand := strings.SplitN(strings.TrimSpace(query[1]), " ", 2)[0]
+		switch subcommand {
+		case "search", "find-text", "trash", "shares":
+			return m.RunCommand(query[0], query[1])
+		}
+	}
 	return m.List()
 }
 
+// Splits args on spaces, except within double quotes, so paths containing
+// spaces can be given as "/static_root/videos/My Movie.mkv".
+func splitArgs(args string) []string {
+	result := []string{}
+	current, quoted, started := "", false, false
+	for _, r := range args {
+		switch {
+		case r == '"':
+			quoted = !quoted
+			started = true
+		case r == ' ' && !quoted:
+			if started {
+				result = append(result, current)
+			}
+			current, started = "", false
+		default:
+			current += string(r)
+			started = true
+		}
+	}
+	if started {
+		result = append(result, current)
+	}
+	return result
+}
+
+// Runs a file operation on writable roots, with paths given as URL paths such
+// as /static_root/videos/clip.mp4:
+//
+//	mkdir <path of new folder>
+//	rename <path> <new name>
+//	move <path> <destination folder>
+//	delete <path>
+//	restore <root> <trash item>
+func (m *StaticContentModule) FileOp(op string, args []string) (template.HTML, error) {
+	wantArgs := map[string]int{"mkdir": 1, "rename": 2, "move": 2, "delete": 1, "restore": 2}
+	if len(args) != wantArgs[op] {
+		return "", errors.New("Usage: files mkdir <path> | rename <path> <name> | " +
+			"move <path> <folder> | delete <path> | restore <root> <item>")
+	}
+	var message string
+	switch op {
+	case "mkdir":
+		p := strings.TrimSuffix(args[0], "/")
+		result, err := m.server.Mkdir(path.Dir(p)+"/", path.Base(p))
+		if err != nil {
+			return "", err
+		}
+		message = "Created " + result
+	case "rename":
+		result, err := m.server.Rename(args[0], args[1])
+		if err != nil {
+			return "", err
+		}
+		message = "Renamed " + args[0] + " to " + result
+	case "move":
+		result, err := m.server.Move(args[0], args[1])
+		if err != nil {
+			return "", err
+		}
+		message = "Moved " + args[0] + " to " + result
+	case "delete":
+		item, err := m.server.Delete(args[0])
+		if err != nil {
+			return "", err
+		}
+		message = "Moved " + args[0] + " to the trash; restore it with \"files restore " +
+			item.Root + " " + item.Id + "\""
+	case "restore":
+		result, err := m.server.Restore(args[0], args[1])
+		if err != nil {
+			return "", err
+		}
+		message = "Restored " + result
+	}
+	return template.HTML(template.HTMLEscapeString(message)), nil
+}
+
+// Shares files, with paths given as URL paths:
+//
+//	share <path> [--expires=24h] [--password=secret]
+//	unshare <share id>
+func (m *StaticContentModule) Share(op string, args []string) (template.HTML, error) {
+	if op == "unshare" {
+		if len(args) != 1 {
+			return "", errors.New("Usage: files unshare <id>")
+		}
+		if err := m.server.Unshare(args[0]); err != nil {
+			return "", err
+		}
+		return template.HTML(template.HTMLEscapeString("Revoked share " + args[0])), nil
+	}
+	usage := errors.New("Usage: files share <path> [--expires=24h] [--password=secret]")
+	expires, password, p := staticcontent.DEFAULT_SHARE_EXPIRY, "", ""
+	for _, arg := range args {
+		switch {
+		case strings.HasPrefix(arg, "--expires="):
+			var err error
+			if expires, err = time.ParseDuration(strings.TrimPrefix(arg, "--expires=")); err != nil {
+				return "", err
+			}
+		case strings.HasPrefix(arg, "--password="):
+			password = strings.TrimPrefix(arg, "--password=")
+		case len(p) == 0:
+			p = arg
+		default:
+			return "", usage
+		}
+	}
+	if len(p) == 0 {
+		return "", usage
+	}
+	link, err := m.server.Share(p, expires, password)
+	if err != nil {
+		return "", err
+	}
+	return template.HTML(`Shared until ` + time.Now().Add(expires).Format("2006-01-02 15:04") +
+		`: <a href="` + template.HTMLEscapeString(link) + `">` + template.HTMLEscapeString(link) + `</a>`), nil
+}
+
+var SHARE_RESULTS_TEMPLATE_FILE = "templates/share_results.html.template"
+
+// Lists live shares in HTML.
+func (m *StaticContentModule) Shares() (template.HTML, error) {
+	template_content, err := resources.Load(SHARE_RESULTS_TEMPLATE_FILE)
+	if err != nil {
+		return "", err
+	}
+	var sharesTemplate = template.New("Share results template")
+	sharesTemplate, err = sharesTemplate.Parse(string(template_content))
+	if err != nil {
+		return "", err
+	}
+
+	var w HTMLWriter
+	sharesTemplate.Execute(&w, m.server.Shares())
+	return w.HTML(), nil
+}
+
 var STATIC_CONTENT_TEMPLATE_FILE = "templates/static_content.html.template"
 
 // Produces a listing in HTML.
@@ -66,3 +248,104 @@ func (m *StaticContentModule) List() (template.HTML, error) {
 	staticContentTemplate.Execute(&w, m.server.Roots())
 	return w.HTML(), nil
 }
+
+var SEARCH_RESULTS_TEMPLATE_FILE = "templates/search_results.html.template"
+
+type searchResult struct {
+	Name    string
+	Url     string
+	Path    string
+	Kind    string
+	Size    string
+	ModTime string
+}
+
+type searchResults struct {
+	Query   string
+	Results []searchResult
+}
+
+// Searches file names and paths across all mapped paths, and produces the
+// results in HTML. See staticcontent.ParseSearch for the query syntax.
+func (m *StaticContentModule) Search(query string) (template.HTML, error) {
+	entries, err := m.server.Search(query)
+	if err != nil {
+		return "", err
+	}
+	template_content, err := resources.Load(SEARCH_RESULTS_TEMPLATE_FILE)
+	if err != nil {
+		return "", err
+	}
+	var searchTemplate = template.New("Search results template")
+	searchTemplate, err = searchTemplate.Parse(string(template_content))
+	if err != nil {
+		return "", err
+	}
+
+	results := &searchResults{Query: query}
+	for _, e := range entries {
+		results.Results = append(results.Results, searchResult{Name: e.Name,
+			Url: e.Url(), Path: e.Root + e.RelPath, Kind: e.Kind, Size: staticcontent.HumanSize(e.Size),
+			ModTime: e.ModTime.Format("2006-01-02 15:04")})
+	}
+	var w HTMLWriter
+	searchTemplate.Execute(&w, results)
+	return w.HTML(), nil
+}
+
+var TEXT_RESULTS_TEMPLATE_FILE = "templates/text_results.html.template"
+
+type textResults struct {
+	Query   string
+	Matches []staticcontent.TextMatch
+}
+
+// Searches the contents of text files across all mapped paths, and produces
+// the matching lines in HTML.
+func (m *StaticContentModule) FindText(query string) (template.HTML, error) {
+	matches, err := m.server.FindText(query)
+	if err != nil {
+		return "", err
+	}
+	template_content, err := resources.Load(TEXT_RESULTS_TEMPLATE_FILE)
+	if err != nil {
+		return "", err
+	}
+	var textTemplate = template.New("Text results template")
+	textTemplate, err = textTemplate.Parse(string(template_content))
+	if err != nil {
+		return "", err
+	}
+
+	var w HTMLWriter
+	textTemplate.Execute(&w, &textResults{Query: query, Matches: matches})
+	return w.HTML(), nil
+}
+
+var TRASH_RESULTS_TEMPLATE_FILE = "templates/trash_results.html.template"
+
+type trashResults struct {
+	Root  string
+	Items []staticcontent.TrashItem
+}
+
+// Lists the trash of a writable root in HTML.
+func (m *StaticContentModule) Trash(root string) (template.HTML, error) {
+	items, err := m.server.Trash(root)
+	if err != nil {
+		return "", err
+	}
+	template_content, err := resources.Load(TRASH_RESULTS_TEMPLATE_FILE)
+	if err != nil {
+		return "", err
+	}
+	var trashTemplate = template.New("Trash results template")
+	trashTemplate, err = trashTemplate.Parse(string(template_content))
+	if err != nil {
+		return "", err
+	}
+
+	var w HTMLWriter
+	trashTemplate.Execute(&w, &trashResults{Root: strings.TrimSuffix(root, "/") + "/", Items: items})
+	return w.HTML(), nil
+}
@@ -4,7 +4,11 @@
 package platform
 
 import (
+	"os"
 	"os/exec"
+	"runtime"
+	"strings"
+	"syscall"
 )
 
 // Configures the given Command to produce a hidden window, if possible. Must
@@ -12,3 +16,21 @@ import (
 func Hide(*exec.Cmd) {
 	// No generic version.
 }
+
+// Returns the file name as the filesystem compares names, so two names that
+// open the same file are equal. macOS's default filesystem ignores case.
+func CanonicalName(name string) string {
+	if runtime.GOOS == "darwin" {
+		return strings.ToLower(name)
+	}
+	return name
+}
+
+// Whether the file is owned by the current user and writable by no one else.
+func PrivateFile(info os.FileInfo) bool {
+	if info.Mode().Perm()&0022 != 0 {
+		return false
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	return !ok || int(stat.Uid) == os.Getuid()
+}
@@ -4,7 +4,9 @@
 package platform
 
 import (
+	"os"
 	"os/exec"
+	"strings"
 	"syscall"
 )
 
@@ -17,3 +19,17 @@ func Hide(c *exec.Cmd) {
 		c.SysProcAttr.HideWindow = true
 	}
 }
+
+// Returns the file name as the filesystem compares names, so two names that
+// open the same file are equal. Windows ignores case, and trailing dots and
+// spaces.
+func CanonicalName(name string) string {
+	return strings.ToLower(strings.TrimRight(name, ". "))
+}
+
+// Whether the file is owned by the current user and writable by no one else.
+// Windows keeps files under a user's profile private with ACLs, which mode
+// bits don't show, so this trusts them.
+func PrivateFile(info os.FileInfo) bool {
+	return true
+}
@@ -11,6 +11,9 @@ import (
 	"strings"
 )
 
+// URL path static content roots are installed under.
+var STATIC_PREFIX = "/static_root"
+
 // A WebCmd webserver.
 type WebCmdServer struct {
 	http.Server
@@ -32,16 +35,19 @@ func CreateServer(host string) *WebCmdServer {
 
 	server := WebCmdServer{
 		Server: http.Server{
-			Addr: host,
+			Addr:    host,
+			Handler: CachingHandler(http.DefaultServeMux),
 		},
 		errorTemplate: errorTemplate,
 		modules:       make(map[string]modules.Module),
 	}
 
-	server.staticContentServer = staticcontent.NewServer("/static_root", server.Server)
+	server.staticContentServer = staticcontent.NewServer(STATIC_PREFIX, server.Server)
 	if err = staticcontent.AddCsvPaths(server.staticContentServer); err != nil {
 		log.Println("Error installing paths from csv:", err)
 	}
+	server.staticContentServer.StartIndexing()
+	server.staticContentServer.StartPurging()
 	allModules := modules.InstalledModules(server.staticContentServer)
 
 	for _, module := range allModules {
@@ -52,13 +58,16 @@ func CreateServer(host string) *WebCmdServer {
 				continue
 			}
 			path := fmt.Sprintf("/%v", command)
-			http.Handle(path, http.HandlerFunc(server.BareModuleHandler(command, module)))
+			http.Handle(path, staticcontent.RequireAuth(
+				http.HandlerFunc(server.BareModuleHandler(command, module))))
 			log.Println("Installing", module.Name(), "at path", path)
 			server.modules[command] = module
 		}
 	}
 
-	http.Handle("/", http.HandlerFunc(server.RootHandler()))
+	// Commands can change and share files, so they need the same credentials
+	// as the files themselves.
+	http.Handle("/", staticcontent.RequireAuth(http.HandlerFunc(server.RootHandler())))
 	return &server
 }
 
@@ -127,7 +136,13 @@ func (server WebCmdServer) RootHandler() func(http.ResponseWriter, *http.Request
 			}
 			if module, has := server.modules[queryPieces[0]]; has {
 				command = queryPieces[0]
-				body, err = module.RunCommand(queryPieces[0], queryPieces[1])
+				if mutator, ok := module.(modules.Mutator); ok &&
+					mutator.Mutates(queryPieces[0], queryPieces[1]) &&
+					(req.Method != "POST" || !staticcontent.SameOrigin(req)) {
+					message = "That command changes files, so it only runs from this page's form."
+				} else {
+					body, err = module.RunCommand(queryPieces[0], queryPieces[1])
+				}
 			} else {
 				message = "Module not found for query. Try again?"
 			}
@@ -181,8 +196,9 @@ func logRequest(req *http.Request) {
 	var form = ""
 	if req.Method == "POST" {
 		req.ParseForm()
-		form = " Form: " + fmt.Sprintf("%v", req.Form)
+		form = " Form: " + fmt.Sprintf("%v", staticcontent.Redact(req.Form))
 	}
-	log.Printf("Request: %v %v %v %v%v %v", req.Method, req.Host, req.URL,
+	log.Printf("Request: %v %v %v %v%v %v", req.Method, req.Host,
+		staticcontent.RedactedUrl(req.URL),
 		req.Proto, form, "From "+req.RemoteAddr)
 }
@@ -0,0 +1,209 @@
+package staticcontent
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"flag"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+var archive_compress_limit = flag.Int64("archive_compress_limit", 16<<20,
+	"Files larger than this (in bytes) are stored uncompressed in ZIP "+
+		"downloads, so large downloads stream at disk speed.")
+
+var (
+	// Downloads a directory, or the entries of it named by PARAM_SELECT, as a
+	// streamed archive.
+	MODE_ZIP = "zip"
+	MODE_TAR = "tar"
+
+	// Names of entries in the directory to download; may be repeated.
+	PARAM_SELECT = "sc_select"
+)
+
+// Kinds of file that are already compressed, so are always stored as-is.
+var compressedKinds = map[string]bool{
+	KIND_VIDEO: true, KIND_AUDIO: true, KIND_IMAGE: true, KIND_ARCHIVE: true,
+}
+
+// Writes files into an archive as they're walked.
+type archiveWriter interface {
+	// Adds a directory or file, with the contents of the file at p.
+	Add(name string, info os.FileInfo, p string) error
+	Close() error
+}
+
+type zipArchive struct {
+	w *zip.Writer
+}
+
+func (a *zipArchive) Add(name string, info os.FileInfo, p string) error {
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	if info.IsDir() {
+		header.Name += "/"
+		_, err := a.w.CreateHeader(header)
+		return err
+	}
+	header.Method = zip.Deflate
+	if info.Size() > *archive_compress_limit || compressedKinds[FileKind(name)] {
+		header.Method = zip.Store
+	}
+	out, err := a.w.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	return copyFileTo(out, p)
+}
+
+func (a *zipArchive) Close() error {
+	return a.w.Close()
+}
+
+type tarArchive struct {
+	w *tar.Writer
+}
+
+func (a *tarArchive) Add(name string, info os.FileInfo, p string) error {
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	if info.IsDir() {
+		header.Name += "/"
+		return a.w.WriteHeader(header)
+	}
+	if err := a.w.WriteHeader(header); err != nil {
+		return err
+	}
+	return copyFileTo(a.w, p)
+}
+
+func (a *tarArchive) Close() error {
+	return a.w.Close()
+}
+
+// Copies the contents of the file at p to w.
+func copyFileTo(w io.Writer, p string) error {
+	file, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.Copy(w, file)
+	return err
+}
+
+// Adds the file or directory at p to the archive as name, recursing into
+// directories. Only entries a listing would show are included, and symlinks
+// to directories aren't followed.
+func (f *FileHandler) addToArchive(a archiveWriter, name string, p string, info os.FileInfo) error {
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Stat(p)
+		if err != nil || target.IsDir() {
+			return nil
+		}
+		info = target
+	}
+	if !info.IsDir() {
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		return a.Add(name, info, p)
+	}
+	if err := a.Add(name, info, p); err != nil {
+		return err
+	}
+	files, err := f.listDir(p)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		err := f.addToArchive(a, path.Join(name, file.Name()), filepath.Join(p, file.Name()), file)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Handler streaming the requested directory as a ZIP or TAR archive. If
+// PARAM_SELECT is given (in the URL or a POSTed form) only those entries of
+// the directory are included. Nothing is buffered on disk; files are read as
+// they're sent.
+func (f *FileHandler) ServeArchive(w http.ResponseWriter, r *http.Request) {
+	dir, err := f.localPath(r)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	stat, err := os.Stat(dir)
+	if err != nil || !stat.IsDir() {
+		http.Error(w, "Only folders can be downloaded as archives.", http.StatusBadRequest)
+		return
+	}
+	files, err := f.listDir(dir)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	name := path.Base("/" + r.URL.Path)
+	if name == "/" {
+		name = path.Base(f.PathPrefix)
+	}
+	prefix := name
+	r.ParseForm()
+	if selected := r.Form[PARAM_SELECT]; len(selected) > 0 {
+		// Only entries the listing shows can be selected.
+		wanted := make(map[string]bool)
+		for _, s := range selected {
+			wanted[s] = true
+		}
+		chosen := files[:0]
+		for _, file := range files {
+			if wanted[file.Name()] {
+				chosen = append(chosen, file)
+			}
+		}
+		if len(chosen) == 0 {
+			http.Error(w, "Nothing selected.", http.StatusBadRequest)
+			return
+		}
+		files, prefix = chosen, ""
+	}
+
+	mode := r.URL.Query().Get(PARAM_MODE)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment",
+		map[string]string{"filename": name + "." + mode}))
+	var a archiveWriter
+	if mode == MODE_TAR {
+		w.Header().Set("Content-Type", "application/x-tar")
+		a = &tarArchive{tar.NewWriter(w)}
+	} else {
+		w.Header().Set("Content-Type", "application/zip")
+		a = &zipArchive{zip.NewWriter(w)}
+	}
+	log.Println("Streaming", len(files), "entries of", dir, "as", mode)
+	for _, file := range files {
+		err := f.addToArchive(a, path.Join(prefix, file.Name()), filepath.Join(dir, file.Name()), file)
+		if err != nil {
+			// The response has started, so all we can do is cut it short.
+			log.Println("Archive of", dir, "aborted:", err)
+			return
+		}
+	}
+	if err := a.Close(); err != nil {
+		log.Println("Archive of", dir, "aborted:", err)
+	}
+}
@@ -0,0 +1,156 @@
+package staticcontent
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var audio_language = flag.String("audio_language", "",
+	"Preferred audio language for multi-language videos (e.g. \"eng\"), used "+
+		"until a user picks a track in the player. If unset, the file's "+
+		"default track is played.")
+
+var (
+	// Which audio stream to play, by stream index.
+	PARAM_AUDIO = "sc_audio"
+
+	// The cookie remembering the language of the audio track a user last
+	// picked, which becomes their preferred language.
+	LANGUAGE_COOKIE = "sc_lang"
+)
+
+// An audio track offered in the player.
+type AudioTrack struct {
+	Index    int
+	Label    string
+	Language string
+	Selected bool
+}
+
+// ISO 639-2 codes (terminological, then bibliographic where it differs) of
+// each ISO 639-1 language, for matching tags written either way.
+var languageCodes = map[string][]string{
+	"af": {"afr"}, "am": {"amh"}, "ar": {"ara"}, "az": {"aze"},
+	"be": {"bel"}, "bg": {"bul"}, "bn": {"ben"}, "bo": {"bod", "tib"},
+	"bs": {"bos"}, "ca": {"cat"}, "cs": {"ces", "cze"}, "cy": {"cym", "wel"},
+	"da": {"dan"}, "de": {"deu", "ger"}, "el": {"ell", "gre"}, "en": {"eng"},
+	"eo": {"epo"}, "es": {"spa"}, "et": {"est"}, "eu": {"eus", "baq"},
+	"fa": {"fas", "per"}, "fi": {"fin"}, "fr": {"fra", "fre"},
+	"ga": {"gle"}, "gd": {"gla"}, "gl": {"glg"}, "gu": {"guj"},
+	"he": {"heb"}, "hi": {"hin"}, "hr": {"hrv"}, "hu": {"hun"},
+	"hy": {"hye", "arm"}, "id": {"ind"}, "is": {"isl", "ice"}, "it": {"ita"},
+	"ja": {"jpn"}, "ka": {"kat", "geo"}, "kk": {"kaz"}, "km": {"khm"},
+	"kn": {"kan"}, "ko": {"kor"}, "ku": {"kur"}, "la": {"lat"},
+	"lb": {"ltz"}, "lo": {"lao"}, "lt": {"lit"}, "lv": {"lav"},
+	"mi": {"mri", "mao"}, "mk": {"mkd", "mac"}, "ml": {"mal"}, "mn": {"mon"},
+	"mr": {"mar"}, "ms": {"msa", "may"}, "mt": {"mlt"}, "my": {"mya", "bur"},
+	"nb": {"nob"}, "ne": {"nep"}, "nl": {"nld", "dut"}, "nn": {"nno"},
+	"no": {"nor"}, "pa": {"pan"}, "pl": {"pol"}, "ps": {"pus"},
+	"pt": {"por"}, "ro": {"ron", "rum"}, "ru": {"rus"}, "si": {"sin"},
+	"sk": {"slk", "slo"}, "sl": {"slv"}, "so": {"som"}, "sq": {"sqi", "alb"},
+	"sr": {"srp"}, "sv": {"swe"}, "sw": {"swa"}, "ta": {"tam"},
+	"te": {"tel"}, "th": {"tha"}, "tl": {"tgl"}, "tr": {"tur"},
+	"uk": {"ukr"}, "ur": {"urd"}, "uz": {"uzb"}, "vi": {"vie"},
+	"yi": {"yid"}, "zh": {"zho", "chi"}, "zu": {"zul"},
+}
+
+// ISO 639-1 codes by their ISO 639-2 forms, built from languageCodes.
+var languageAliases = map[string]string{}
+
+func init() {
+	for short, codes := range languageCodes {
+		for _, code := range codes {
+			languageAliases[code] = short
+		}
+	}
+}
+
+// Returns the ISO 639-1 form of a language tag like "ger", "deu" or
+// "de-AT", or the tag itself (lowercase, without a region) if it has none.
+func canonicalLanguage(tag string) string {
+	tag = strings.ToLower(strings.TrimSpace(tag))
+	if i := strings.IndexAny(tag, "-_"); i >= 0 {
+		tag = tag[:i]
+	}
+	if short, has := languageAliases[tag]; has {
+		return short
+	}
+	return tag
+}
+
+// Whether two language tags refer to the same language, allowing for the
+// ISO 639-1 ("de"), 639-2/T ("deu") and 639-2/B ("ger") forms.
+func sameLanguage(a, b string) bool {
+	a, b = canonicalLanguage(a), canonicalLanguage(b)
+	return len(a) >= 2 && a == b
+}
+
+// Returns the audio stream to play for r: the one requested via sc_audio,
+// else the first in the user's preferred language (from their cookie, then
+// --audio_language), else the file's default. Returns nil if the file has no
+// audio.
+func ChooseAudio(r *http.Request, info *MediaInfo) *Stream {
+	streams := info.All("audio")
+	if len(streams) == 0 {
+		return nil
+	}
+	if index, err := strconv.Atoi(r.FormValue(PARAM_AUDIO)); err == nil {
+		for i := range streams {
+			if streams[i].Index == index {
+				return &streams[i]
+			}
+		}
+	}
+
+	languages := []string{}
+	if cookie, err := r.Cookie(LANGUAGE_COOKIE); err == nil {
+		languages = append(languages, cookie.Value)
+	}
+	languages = append(languages, *audio_language)
+	for _, language := range languages {
+		for i := range streams {
+			if sameLanguage(streams[i].Language, language) {
+				return &streams[i]
+			}
+		}
+	}
+
+	for i := range streams {
+		if streams[i].Default {
+			return &streams[i]
+		}
+	}
+	return &streams[0]
+}
+
+// Lists the audio tracks of a file for the player, marking chosen as selected.
+func AudioTracks(info *MediaInfo, chosen *Stream) []AudioTrack {
+	tracks := []AudioTrack{}
+	for _, s := range info.All("audio") {
+		label := s.Title
+		if len(label) == 0 {
+			label = s.Language
+		}
+		if len(label) == 0 {
+			label = fmt.Sprintf("Track %v", s.Index)
+		}
+		if s.Channels > 0 {
+			label = fmt.Sprintf("%v (%v, %vch)", label, s.CodecName, s.Channels)
+		}
+		tracks = append(tracks, AudioTrack{Index: s.Index, Label: label,
+			Language: s.Language, Selected: chosen != nil && chosen.Index == s.Index})
+	}
+	return tracks
+}
+
+// Transcoder arguments selecting the first video stream and the given audio
+// stream, or nil to leave the choice to the transcoder.
+func audioMapArgs(audio *Stream) []string {
+	if audio == nil {
+		return nil
+	}
+	return []string{"-map", "0:v:0?", "-map", fmt.Sprintf("0:%v", audio.Index)}
+}
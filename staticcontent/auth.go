@@ -0,0 +1,69 @@
+package staticcontent
+
+import (
+	"crypto/subtle"
+	"errors"
+	"flag"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+var static_auth = flag.String("static_auth", "",
+	"If set, as user:password, static content, WebDAV and the command "+
+		"interface require these credentials (via HTTP basic auth).")
+
+// Whether static content requires credentials.
+func AuthEnabled() bool {
+	return len(*static_auth) > 0
+}
+
+// Whether r carries the credentials set by --static_auth, or none are needed.
+func authorized(r *http.Request) bool {
+	if !AuthEnabled() {
+		return true
+	}
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	want := strings.SplitN(*static_auth, ":", 2)
+	if len(want) != 2 {
+		want = append(want, "")
+	}
+	userOk := subtle.ConstantTimeCompare([]byte(user), []byte(want[0])) == 1
+	passwordOk := subtle.ConstantTimeCompare([]byte(password), []byte(want[1])) == 1
+	return userOk && passwordOk
+}
+
+// Wraps h so that requests without the credentials set by --static_auth are
+// refused.
+func RequireAuth(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(r) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="WebCmd"`)
+			http.Error(w, "Unauthorized.", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// Whether r came from one of our own pages rather than another site: its
+// Origin header (or failing that, its Referer) must name this host. Browsers
+// send one of them with every cross-site POST, so requests without either,
+// like scripts', are let through. Browsers resend basic auth credentials to
+// any page's requests, so changes must check this too.
+func SameOrigin(r *http.Request) bool {
+	source := r.Header.Get("Origin")
+	if len(source) == 0 {
+		source = r.Header.Get("Referer")
+	}
+	if len(source) == 0 {
+		return true
+	}
+	u, err := url.Parse(source)
+	return err == nil && len(u.Host) > 0 && strings.EqualFold(u.Host, r.Host)
+}
+
+var errCrossSite = errors.New("Cross-site requests can't change files.")
@@ -0,0 +1,500 @@
+package staticcontent
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"crypto/sha1"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var archive_cache = flag.String("archive_cache",
+	filepath.Join(os.TempDir(), "webcmd_archives"),
+	"Directory to extract videos and images inside archives to, so they can "+
+		"be probed, transcoded and thumbnailed.")
+var archive_cache_age = flag.Duration("archive_cache_age", 24*time.Hour,
+	"How long a file extracted from an archive may go unused before being "+
+		"purged. If 0, they're kept regardless of age.")
+var archive_cache_size = flag.Int64("archive_cache_size", 10<<30,
+	"Most bytes of files extracted from archives to keep; the least "+
+		"recently used are purged beyond this. If 0, there's no limit.")
+
+// Separates the path of an archive from the path of a member within it, as
+// in /static_root/backups/site.zip/!/index.html.
+var ARCHIVE_SEPARATOR = "/!/"
+
+// Formats of archive that can be browsed.
+const (
+	formatZip   = "zip"
+	formatTar   = "tar"
+	formatTarGz = "tar.gz"
+)
+
+// Returns which format of browsable archive name is, or "" if it isn't one.
+func archiveFormat(name string) string {
+	lower := strings.ToLower(name)
+	switch {
+	case strings.HasSuffix(lower, ".zip"):
+		return formatZip
+	case strings.HasSuffix(lower, ".tar"):
+		return formatTar
+	case strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+		return formatTarGz
+	}
+	return ""
+}
+
+// A file or directory inside an archive.
+type archiveMember struct {
+	Name    string // Slash-separated path within the archive
+	Size    int64
+	ModTime time.Time
+	IsDir   bool
+	// Where the member's data starts in the archive file, if it's stored
+	// uncompressed; otherwise -1.
+	Offset int64
+}
+
+// Describes an archive member as an os.FileInfo, for listings.
+type memberInfo struct {
+	m archiveMember
+}
+
+func (i memberInfo) Name() string       { return path.Base(i.m.Name) }
+func (i memberInfo) Size() int64        { return i.m.Size }
+func (i memberInfo) ModTime() time.Time { return i.m.ModTime }
+func (i memberInfo) IsDir() bool        { return i.m.IsDir }
+func (i memberInfo) Sys() interface{}   { return nil }
+func (i memberInfo) Mode() os.FileMode {
+	if i.m.IsDir {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
+
+type cachedMembers struct {
+	modTime time.Time
+	size    int64
+	members []archiveMember
+}
+
+// Archive contents already read, by OS path. Reading a compressed tar means
+// decompressing all of it, so they're kept until the archive changes.
+var archiveCache = struct {
+	sync.Mutex
+	archives map[string]cachedMembers
+}{archives: make(map[string]cachedMembers)}
+
+// Reads through a file, keeping track of the position. Seeking is passed
+// through, so tar can skip over member data.
+type positionReader struct {
+	file *os.File
+	pos  int64
+}
+
+func (r *positionReader) Read(b []byte) (int, error) {
+	n, err := r.file.Read(b)
+	r.pos += int64(n)
+	return n, err
+}
+
+func (r *positionReader) Seek(offset int64, whence int) (int64, error) {
+	pos, err := r.file.Seek(offset, whence)
+	if err == nil {
+		r.pos = pos
+	}
+	return pos, err
+}
+
+// Returns the members of the archive at p, including directories only implied
+// by the paths of the files in them.
+func archiveMembers(p string, stat os.FileInfo) ([]archiveMember, error) {
+	archiveCache.Lock()
+	cached, has := archiveCache.archives[p]
+	archiveCache.Unlock()
+	if has && cached.modTime.Equal(stat.ModTime()) && cached.size == stat.Size() {
+		return cached.members, nil
+	}
+
+	var members []archiveMember
+	var err error
+	switch archiveFormat(p) {
+	case formatZip:
+		members, err = zipMembers(p)
+	case formatTar, formatTarGz:
+		members, err = tarMembers(p)
+	default:
+		err = errors.New("Browsing " + filepath.Ext(p) + " archives isn't supported.")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Add the implied directories, and drop anything that would escape the
+	// archive or repeats an earlier member.
+	seen := make(map[string]bool)
+	all := []archiveMember{}
+	for _, m := range members {
+		m.Name = strings.Trim(path.Clean("/"+m.Name), "/")
+		if len(m.Name) == 0 || seen[m.Name] {
+			continue
+		}
+		seen[m.Name] = true
+		all = append(all, m)
+		for dir := path.Dir(m.Name); dir != "."; dir = path.Dir(dir) {
+			if !seen[dir] {
+				seen[dir] = true
+				all = append(all, archiveMember{Name: dir, IsDir: true,
+					ModTime: m.ModTime, Offset: -1})
+			}
+		}
+	}
+	archiveCache.Lock()
+	archiveCache.archives[p] = cachedMembers{stat.ModTime(), stat.Size(), all}
+	archiveCache.Unlock()
+	return all, nil
+}
+
+func zipMembers(p string) ([]archiveMember, error) {
+	reader, err := zip.OpenReader(p)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	members := []archiveMember{}
+	for _, file := range reader.File {
+		m := archiveMember{Name: file.Name, Size: int64(file.UncompressedSize64),
+			ModTime: file.Modified, IsDir: file.FileInfo().IsDir(), Offset: -1}
+		if file.Method == zip.Store && !m.IsDir {
+			if offset, err := file.DataOffset(); err == nil {
+				m.Offset = offset
+			}
+		}
+		members = append(members, m)
+	}
+	return members, nil
+}
+
+func tarMembers(p string) ([]archiveMember, error) {
+	file, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var reader *tar.Reader
+	counter := &positionReader{file: file}
+	compressed := archiveFormat(p) == formatTarGz
+	if compressed {
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			return nil, err
+		}
+		reader = tar.NewReader(gz)
+	} else {
+		reader = tar.NewReader(counter)
+	}
+	members := []archiveMember{}
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		m := archiveMember{Name: header.Name, Size: header.Size,
+			ModTime: header.ModTime, Offset: -1}
+		switch header.Typeflag {
+		case tar.TypeDir:
+			m.IsDir = true
+		case tar.TypeReg, tar.TypeRegA:
+			if !compressed {
+				m.Offset = counter.pos
+			}
+		default:
+			// Links, devices and the like have no contents of their own.
+			continue
+		}
+		members = append(members, m)
+	}
+	return members, nil
+}
+
+// A member's data, with the archive file it's read from.
+type memberReader struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (r *memberReader) Close() error {
+	for _, c := range r.closers {
+		c.Close()
+	}
+	return nil
+}
+
+// A member stored uncompressed, which can be read from anywhere.
+type memberSection struct {
+	*io.SectionReader
+	file *os.File
+}
+
+func (r *memberSection) Close() error {
+	return r.file.Close()
+}
+
+// Opens the contents of the member m of the archive at p. The result is an
+// io.ReadSeeker too if the member is stored uncompressed.
+func openMember(p string, m archiveMember) (io.ReadCloser, error) {
+	if m.Offset >= 0 {
+		file, err := os.Open(p)
+		if err != nil {
+			return nil, err
+		}
+		return &memberSection{io.NewSectionReader(file, m.Offset, m.Size), file}, nil
+	}
+	switch archiveFormat(p) {
+	case formatZip:
+		reader, err := zip.OpenReader(p)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range reader.File {
+			if strings.Trim(path.Clean("/"+file.Name), "/") == m.Name {
+				data, err := file.Open()
+				if err != nil {
+					reader.Close()
+					return nil, err
+				}
+				return &memberReader{data, []io.Closer{data, reader}}, nil
+			}
+		}
+		reader.Close()
+	case formatTar, formatTarGz:
+		file, err := os.Open(p)
+		if err != nil {
+			return nil, err
+		}
+		var in io.Reader = file
+		if archiveFormat(p) == formatTarGz {
+			if in, err = gzip.NewReader(file); err != nil {
+				file.Close()
+				return nil, err
+			}
+		}
+		reader := tar.NewReader(in)
+		for {
+			header, err := reader.Next()
+			if err != nil {
+				break
+			}
+			if strings.Trim(path.Clean("/"+header.Name), "/") == m.Name {
+				return &memberReader{reader, []io.Closer{file}}, nil
+			}
+		}
+		file.Close()
+	}
+	return nil, errors.New("No such file in archive: " + m.Name)
+}
+
+// Guards extractions into --archive_cache, so each member is extracted once
+// while others are extracted alongside. Maps the cache directories being
+// extracted to, or waited on, to their locks.
+var (
+	extractLock  sync.Mutex
+	extractLocks = make(map[string]*keyLock)
+)
+
+// The lock of one cache directory, and how many requests hold or wait on it.
+type keyLock struct {
+	sync.Mutex
+	users int
+}
+
+// Locks the cache directory dir, returning the function unlocking it.
+func lockExtraction(dir string) func() {
+	extractLock.Lock()
+	l := extractLocks[dir]
+	if l == nil {
+		l = &keyLock{}
+		extractLocks[dir] = l
+	}
+	l.users++
+	extractLock.Unlock()
+	l.Lock()
+	return func() {
+		l.Unlock()
+		extractLock.Lock()
+		if l.users--; l.users == 0 {
+			delete(extractLocks, dir)
+		}
+		extractLock.Unlock()
+	}
+}
+
+// Removes extracted files unused for --archive_cache_age, then the least
+// recently used beyond --archive_cache_size. Extractions in progress are left
+// alone.
+func PurgeArchiveCache() {
+	purgeCache(*archive_cache, *archive_cache_age, *archive_cache_size,
+		func(p string) bool {
+			extractLock.Lock()
+			defer extractLock.Unlock()
+			return extractLocks[p] != nil
+		})
+}
+
+// Extracts the member m of the archive at p (with the given stat) into
+// --archive_cache, if it isn't there already, and returns the directory it's
+// in. The extracted file has the member's name, so it's treated like the
+// original.
+func extractMember(p string, stat os.FileInfo, m archiveMember) (string, error) {
+	key := fmt.Sprintf("%x", sha1.Sum([]byte(fmt.Sprintf("%v|%v|%v|%v",
+		p, stat.ModTime().UnixNano(), stat.Size(), m.Name))))
+	dir := filepath.Join(*archive_cache, key)
+	target := filepath.Join(dir, path.Base(m.Name))
+	defer lockExtraction(dir)()
+	if _, err := os.Stat(target); err == nil {
+		touchCached(dir)
+		return dir, nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	in, err := openMember(p, m)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+	log.Println("Extracting", m.Name, "from", p, "to", dir)
+	tmp := target + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, target)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	return dir, nil
+}
+
+// Splits a request path of a member of an archive into the archive's path
+// and the member's, if it is one.
+func splitArchivePath(upath string) (string, string, bool) {
+	i := strings.Index(upath+"/", ARCHIVE_SEPARATOR)
+	if i < 0 || len(archiveFormat(upath[:i])) == 0 {
+		return "", "", false
+	}
+	member := ""
+	if i+len(ARCHIVE_SEPARATOR) <= len(upath) {
+		member = upath[i+len(ARCHIVE_SEPARATOR):]
+	}
+	return upath[:i], member, true
+}
+
+// Handler for paths inside archives: directories are listed like real ones,
+// and files are served from the archive. Videos and images are extracted
+// first so the player, transcoding and thumbnails work on them as usual.
+func (f *FileHandler) ServeArchiveMember(w http.ResponseWriter, r *http.Request, archivePath string, member string) {
+	p, err := f.osPath(archivePath)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	stat, err := os.Stat(p)
+	if err != nil || !stat.Mode().IsRegular() {
+		http.NotFound(w, r)
+		return
+	}
+	members, err := archiveMembers(p, stat)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+		return
+	}
+
+	name := strings.Trim(member, "/")
+	var found *archiveMember
+	for i := range members {
+		if members[i].Name == name {
+			found = &members[i]
+			break
+		}
+	}
+	if len(name) == 0 || found != nil && found.IsDir {
+		if !strings.HasSuffix(r.URL.Path, "/") {
+			target := f.PathPrefix + r.URL.Path + "/"
+			if len(r.URL.RawQuery) > 0 {
+				target += "?" + r.URL.RawQuery
+			}
+			http.Redirect(w, r, target, http.StatusMovedPermanently)
+			return
+		}
+		files := []os.FileInfo{}
+		for _, m := range members {
+			if path.Dir(m.Name) == name || len(name) == 0 && path.Dir(m.Name) == "." {
+				files = append(files, memberInfo{m})
+			}
+		}
+		f.renderListing(w, r, files, true)
+		return
+	}
+	if found == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	mode := r.URL.Query().Get(PARAM_MODE)
+	extract := IsVideo(name) && mode != MODE_RAW || IsImage(name) && mode == MODE_THUMBNAIL
+	if extract {
+		dir, err := extractMember(p, stat, *found)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// Serve the extracted copy as though it were in a root of its own.
+		extracted := newFileHandler(f.PathPrefix+path.Dir(r.URL.Path)+"/", dir,
+			RootOptions{}, f.server)
+		r2 := new(http.Request)
+		*r2 = *r
+		r2.URL = new(url.URL)
+		*r2.URL = *r.URL
+		r2.URL.Path = path.Base(name)
+		extracted.ServeHTTP(w, r2)
+		return
+	}
+
+	data, err := openMember(p, *found)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer data.Close()
+	if seeker, ok := data.(io.ReadSeeker); ok {
+		http.ServeContent(w, r, path.Base(name), found.ModTime, seeker)
+		return
+	}
+	w.Header().Set("Content-Type", mimeType(name))
+	w.Header().Set("Content-Length", fmt.Sprint(found.Size))
+	if r.Method != "HEAD" {
+		io.Copy(w, data)
+	}
+}
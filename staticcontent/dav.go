@@ -0,0 +1,628 @@
+package staticcontent
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The path WebDAV access to every root is served under, e.g. /dav/videos/
+// for the root served at /static_root/videos/.
+var DAV_PREFIX = "/dav"
+
+// Longest lock a client can take out, and the default if it doesn't ask.
+var MAX_DAV_LOCK = time.Hour
+
+// A WebDAV write lock. Locks are only kept in memory, and all are exclusive.
+type davLock struct {
+	token    string
+	path     string // Static content URL path of the locked resource
+	infinite bool   // Whether it covers everything below path too
+	owner    string // Owner XML the client sent, echoed back as-is
+	expires  time.Time
+}
+
+var davLocks = struct {
+	sync.Mutex
+	locks map[string]*davLock // By token
+}{locks: make(map[string]*davLock)}
+
+// Whether lock l covers the static content URL path p.
+func (l *davLock) covers(p string) bool {
+	return l.path == p || l.infinite && strings.HasPrefix(p, l.path+"/")
+}
+
+// Returns an unexpired lock covering p, if any. The caller must hold davLocks.
+func lockOn(p string) *davLock {
+	for token, l := range davLocks.locks {
+		if time.Now().After(l.expires) {
+			delete(davLocks.locks, token)
+		} else if l.covers(p) {
+			return l
+		}
+	}
+	return nil
+}
+
+// Whether r may change each of the static content URL paths: they must be
+// unlocked, or r must give the lock's token in its If header.
+func davUnlocked(r *http.Request, paths ...string) bool {
+	davLocks.Lock()
+	defer davLocks.Unlock()
+	for _, p := range paths {
+		if l := lockOn(p); l != nil && !strings.Contains(r.Header.Get("If"), l.token) {
+			return false
+		}
+	}
+	return true
+}
+
+// Like davUnlocked, for requests that remove or replace whole trees (DELETE,
+// MOVE and the destinations of COPY and MOVE): locks on anything below each
+// path must be given in r's If header too.
+func davTreeUnlocked(r *http.Request, paths ...string) bool {
+	davLocks.Lock()
+	defer davLocks.Unlock()
+	for _, p := range paths {
+		for token, l := range davLocks.locks {
+			if time.Now().After(l.expires) {
+				delete(davLocks.locks, token)
+			} else if (l.covers(p) || strings.HasPrefix(l.path, p+"/")) &&
+				!strings.Contains(r.Header.Get("If"), l.token) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Drops the locks on p and everything below it, once it's gone.
+func dropLocks(p string) {
+	davLocks.Lock()
+	defer davLocks.Unlock()
+	for token, l := range davLocks.locks {
+		if l.path == p || strings.HasPrefix(l.path, p+"/") {
+			delete(davLocks.locks, token)
+		}
+	}
+}
+
+// Handler serving every root of a Server over WebDAV, under DAV_PREFIX. Reads
+// and writes go through the same roots, path checks and listings as the
+// FileHandlers; roots that aren't writable are read-only, and deleted files
+// go to the root's trash.
+type davHandler struct {
+	server *Server
+}
+
+// Returns the static content URL path a WebDAV path refers to, without any
+// trailing slash.
+func (d *davHandler) staticPath(davPath string) string {
+	rel := strings.TrimPrefix(path.Clean("/"+davPath), DAV_PREFIX)
+	return strings.TrimSuffix(d.server.prefix+rel, "/")
+}
+
+// Returns the WebDAV href of a static content URL path.
+func (d *davHandler) href(staticPath string, isDir bool) string {
+	href := DAV_PREFIX + escapePath(strings.TrimPrefix(staticPath, d.server.prefix))
+	if isDir && !strings.HasSuffix(href, "/") {
+		href += "/"
+	}
+	return href
+}
+
+// Whether a WebDAV path is the collection of all roots.
+func (d *davHandler) isTop(davPath string) bool {
+	return strings.Trim(davPath, "/") == strings.Trim(DAV_PREFIX, "/")
+}
+
+func (d *davHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	logRequest(r)
+	if r.Method == "OPTIONS" {
+		w.Header().Set("DAV", "1, 2")
+		w.Header().Set("MS-Author-Via", "DAV")
+		w.Header().Set("Allow", "OPTIONS, GET, HEAD, PUT, DELETE, MKCOL, COPY, "+
+			"MOVE, PROPFIND, PROPPATCH, LOCK, UNLOCK")
+		return
+	}
+	if d.isTop(r.URL.Path) {
+		d.serveTop(w, r)
+		return
+	}
+	p := d.staticPath(r.URL.Path)
+	f, osPath, err := d.server.resolve(p)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	switch r.Method {
+	case "GET", "HEAD":
+		d.serveGet(w, r, f, p, osPath)
+		return
+	case "PROPFIND":
+		d.servePropfind(w, r, f, p, osPath)
+		return
+	}
+	// Everything else changes the root, except copying out of it.
+	if !f.Options.Writable && r.Method != "COPY" {
+		http.Error(w, errReadOnly.Error(), http.StatusForbidden)
+		return
+	}
+	switch r.Method {
+	case "PUT":
+		d.servePut(w, r, p, osPath)
+	case "DELETE":
+		d.serveDelete(w, r, f, p, osPath)
+	case "MKCOL":
+		d.serveMkcol(w, r, p, osPath)
+	case "COPY", "MOVE":
+		d.serveCopyMove(w, r, f, p, osPath)
+	case "PROPPATCH":
+		d.serveProppatch(w, r, p)
+	case "LOCK":
+		d.serveLock(w, r, p, osPath)
+	case "UNLOCK":
+		d.serveUnlock(w, r, p)
+	default:
+		http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+	}
+}
+
+// Serves the collection of all roots, which can be listed but not changed.
+func (d *davHandler) serveTop(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET", "HEAD":
+		w.Write([]byte("WebCmd WebDAV: mount this URL, or a root under it, as a network drive.\n"))
+	case "PROPFIND":
+		var body bytes.Buffer
+		top := memberInfo{archiveMember{Name: DAV_PREFIX, IsDir: true, ModTime: time.Now()}}
+		writeDavResponse(&body, DAV_PREFIX+"/", top, nil)
+		if r.Header.Get("Depth") != "0" {
+			for _, root := range d.server.Roots() {
+				if info, err := os.Stat(d.server.handlers[root].OSPath); err == nil {
+					writeDavResponse(&body, d.href(root, true), info, nil)
+				}
+			}
+		}
+		writeMultistatus(w, body.Bytes())
+	default:
+		http.Error(w, errReadOnly.Error(), http.StatusForbidden)
+	}
+}
+
+// Serves files; directories redirect to their listing.
+func (d *davHandler) serveGet(w http.ResponseWriter, r *http.Request, f *FileHandler, p string, osPath string) {
+	w, done := f.throttle(w, r)
+	defer done()
+	stat, err := os.Stat(osPath)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	if stat.IsDir() {
+		http.Redirect(w, r, escapePath(p)+"/", http.StatusFound)
+		return
+	}
+	file, err := os.Open(osPath)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer file.Close()
+	http.ServeContent(w, r, stat.Name(), stat.ModTime(), file)
+}
+
+// Escapes s for use as XML character data.
+func xmlEscape(s string) string {
+	var b bytes.Buffer
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// Writes the properties of one resource as a multistatus response element.
+func writeDavResponse(w io.Writer, href string, info os.FileInfo, lock *davLock) {
+	fmt.Fprintf(w, "<D:response><D:href>%v</D:href><D:propstat><D:prop>", xmlEscape(href))
+	fmt.Fprintf(w, "<D:displayname>%v</D:displayname>", xmlEscape(info.Name()))
+	fmt.Fprintf(w, "<D:getlastmodified>%v</D:getlastmodified>",
+		info.ModTime().UTC().Format(http.TimeFormat))
+	fmt.Fprintf(w, "<D:creationdate>%v</D:creationdate>",
+		info.ModTime().UTC().Format(time.RFC3339))
+	if info.IsDir() {
+		fmt.Fprint(w, "<D:resourcetype><D:collection/></D:resourcetype>")
+	} else {
+		contentType := mimeType(info.Name())
+		fmt.Fprint(w, "<D:resourcetype/>")
+		fmt.Fprintf(w, "<D:getcontentlength>%v</D:getcontentlength>", info.Size())
+		fmt.Fprintf(w, "<D:getcontenttype>%v</D:getcontenttype>", xmlEscape(contentType))
+		fmt.Fprintf(w, `<D:getetag>"%x-%x"</D:getetag>`, info.ModTime().UnixNano(), info.Size())
+	}
+	fmt.Fprint(w, "<D:supportedlock><D:lockentry><D:lockscope><D:exclusive/>"+
+		"</D:lockscope><D:locktype><D:write/></D:locktype></D:lockentry>"+
+		"</D:supportedlock>")
+	fmt.Fprint(w, "<D:lockdiscovery>")
+	if lock != nil {
+		writeActiveLock(w, lock, href)
+	}
+	fmt.Fprint(w, "</D:lockdiscovery>")
+	fmt.Fprint(w, "</D:prop><D:status>HTTP/1.1 200 OK</D:status></D:propstat></D:response>")
+}
+
+// Writes the description of an active lock.
+func writeActiveLock(w io.Writer, lock *davLock, href string) {
+	depth := "0"
+	if lock.infinite {
+		depth = "infinity"
+	}
+	fmt.Fprintf(w, "<D:activelock><D:locktype><D:write/></D:locktype>"+
+		"<D:lockscope><D:exclusive/></D:lockscope><D:depth>%v</D:depth>"+
+		"<D:owner>%v</D:owner><D:timeout>Second-%v</D:timeout>"+
+		"<D:locktoken><D:href>%v</D:href></D:locktoken>"+
+		"<D:lockroot><D:href>%v</D:href></D:lockroot></D:activelock>",
+		depth, lock.owner, int(time.Until(lock.expires).Seconds()),
+		lock.token, xmlEscape(href))
+}
+
+// Writes a 207 Multi-Status response around the given response elements.
+func writeMultistatus(w http.ResponseWriter, responses []byte) {
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(207)
+	fmt.Fprint(w, `<?xml version="1.0" encoding="utf-8"?><D:multistatus xmlns:D="DAV:">`)
+	w.Write(responses)
+	fmt.Fprint(w, "</D:multistatus>")
+}
+
+// Lists a resource's properties, and its children's unless the Depth header
+// is 0. All live properties are always returned, whichever were asked for.
+func (d *davHandler) servePropfind(w http.ResponseWriter, r *http.Request, f *FileHandler, p string, osPath string) {
+	stat, err := os.Stat(osPath)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	davLocks.Lock()
+	lock := lockOn(p)
+	davLocks.Unlock()
+	var body bytes.Buffer
+	writeDavResponse(&body, d.href(p, stat.IsDir()), stat, lock)
+	if stat.IsDir() && r.Header.Get("Depth") != "0" {
+		files, err := f.listDir(osPath)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for _, file := range files {
+			child := p + "/" + file.Name()
+			if file.Mode()&os.ModeSymlink != 0 {
+				if target, err := os.Stat(filepath.Join(osPath, file.Name())); err == nil {
+					file = target
+				}
+			}
+			davLocks.Lock()
+			lock := lockOn(child)
+			davLocks.Unlock()
+			writeDavResponse(&body, d.href(child, file.IsDir()), file, lock)
+		}
+	}
+	writeMultistatus(w, body.Bytes())
+}
+
+// Writes the request body to the file, replacing it atomically.
+func (d *davHandler) servePut(w http.ResponseWriter, r *http.Request, p string, osPath string) {
+	if !davUnlocked(r, p) {
+		http.Error(w, "Locked.", http.StatusLocked)
+		return
+	}
+	if err := validName(filepath.Base(osPath)); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	stat, err := os.Stat(osPath)
+	exists := err == nil
+	if exists && stat.IsDir() {
+		http.Error(w, "Can't write to a folder.", http.StatusMethodNotAllowed)
+		return
+	}
+	dir := filepath.Dir(osPath)
+	if stat, err := os.Stat(dir); err != nil || !stat.IsDir() {
+		http.Error(w, "No such folder.", http.StatusConflict)
+		return
+	}
+	tmp, err := ioutil.TempFile(dir, partialUploadPrefix)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	n, err := io.Copy(tmp, io.LimitReader(r.Body, *max_upload_size+1))
+	tmp.Chmod(0644)
+	tmp.Close()
+	if err == nil && n > *max_upload_size {
+		err = errors.New("File too large.")
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), osPath)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if exists {
+		w.WriteHeader(http.StatusNoContent)
+	} else {
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+// Moves the resource to its root's trash.
+func (d *davHandler) serveDelete(w http.ResponseWriter, r *http.Request, f *FileHandler, p string, osPath string) {
+	if _, err := os.Lstat(osPath); err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	if !davTreeUnlocked(r, p) {
+		http.Error(w, "Locked.", http.StatusLocked)
+		return
+	}
+	if _, err := d.server.Delete(p); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	dropLocks(p)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Creates a folder.
+func (d *davHandler) serveMkcol(w http.ResponseWriter, r *http.Request, p string, osPath string) {
+	if r.ContentLength > 0 {
+		http.Error(w, "MKCOL bodies aren't supported.", http.StatusUnsupportedMediaType)
+		return
+	}
+	if _, err := os.Lstat(osPath); err == nil {
+		http.Error(w, "Already exists.", http.StatusMethodNotAllowed)
+		return
+	}
+	if !davUnlocked(r, p) {
+		http.Error(w, "Locked.", http.StatusLocked)
+		return
+	}
+	if stat, err := os.Stat(filepath.Dir(osPath)); err != nil || !stat.IsDir() {
+		http.Error(w, "No such folder.", http.StatusConflict)
+		return
+	}
+	if err := validName(filepath.Base(osPath)); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	log.Println("Creating folder", osPath)
+	if err := os.Mkdir(osPath, 0755); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+// Copies or moves the resource to the Destination header's path, which may
+// be in another writable root.
+func (d *davHandler) serveCopyMove(w http.ResponseWriter, r *http.Request, f *FileHandler, p string, osPath string) {
+	dest, err := url.Parse(r.Header.Get("Destination"))
+	if err != nil || !strings.HasPrefix(dest.Path, DAV_PREFIX+"/") || d.isTop(dest.Path) {
+		http.Error(w, "Invalid destination.", http.StatusBadGateway)
+		return
+	}
+	destPath := d.staticPath(dest.Path)
+	destF, destOSPath, err := d.server.resolve(destPath)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if !destF.Options.Writable {
+		http.Error(w, errReadOnly.Error(), http.StatusForbidden)
+		return
+	}
+	if err := validName(filepath.Base(destOSPath)); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if _, err := os.Lstat(osPath); err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	if osPath == filepath.Clean(f.OSPath) || destOSPath == filepath.Clean(destF.OSPath) {
+		http.Error(w, "Roots themselves can't be changed.", http.StatusForbidden)
+		return
+	}
+	if destOSPath == osPath || strings.HasPrefix(destOSPath, osPath+string(filepath.Separator)) {
+		http.Error(w, "Can't copy or move a folder into itself.", http.StatusForbidden)
+		return
+	}
+	if stat, err := os.Stat(filepath.Dir(destOSPath)); err != nil || !stat.IsDir() {
+		http.Error(w, "No such folder.", http.StatusConflict)
+		return
+	}
+	locked := []string{destPath}
+	if r.Method == "MOVE" {
+		locked = append(locked, p)
+	}
+	if !davTreeUnlocked(r, locked...) {
+		http.Error(w, "Locked.", http.StatusLocked)
+		return
+	}
+
+	_, err = os.Lstat(destOSPath)
+	exists := err == nil
+	if exists {
+		if r.Header.Get("Overwrite") == "F" {
+			http.Error(w, "Destination exists.", http.StatusPreconditionFailed)
+			return
+		}
+		if _, err := d.server.Delete(destPath); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	log.Println("WebDAV", r.Method, osPath, "to", destOSPath)
+	if r.Method == "MOVE" {
+		err = moveFile(f, osPath, destOSPath, f != destF)
+		dropLocks(p)
+	} else {
+		err = f.copyTree(osPath, destOSPath)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if exists {
+		w.WriteHeader(http.StatusNoContent)
+	} else {
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+// Accepts property changes without storing them, which is what clients
+// setting Windows attributes or macOS metadata need to carry on.
+func (d *davHandler) serveProppatch(w http.ResponseWriter, r *http.Request, p string) {
+	if !davUnlocked(r, p) {
+		http.Error(w, "Locked.", http.StatusLocked)
+		return
+	}
+	var props bytes.Buffer
+	decoder := xml.NewDecoder(io.LimitReader(r.Body, 1<<20))
+	depth, propDepth := 0, -1
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			break
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			depth++
+			if t.Name.Space == "DAV:" && t.Name.Local == "prop" {
+				propDepth = depth
+			} else if propDepth >= 0 && depth == propDepth+1 {
+				fmt.Fprintf(&props, `<x:%v xmlns:x="%v"/>`, t.Name.Local, xmlEscape(t.Name.Space))
+			}
+		case xml.EndElement:
+			if depth == propDepth {
+				propDepth = -1
+			}
+			depth--
+		}
+	}
+	var body bytes.Buffer
+	fmt.Fprintf(&body, "<D:response><D:href>%v</D:href><D:propstat><D:prop>%v</D:prop>"+
+		"<D:status>HTTP/1.1 200 OK</D:status></D:propstat></D:response>",
+		xmlEscape(d.href(p, false)), props.String())
+	writeMultistatus(w, body.Bytes())
+}
+
+// The body of a LOCK request.
+type davLockInfo struct {
+	Owner struct {
+		InnerXML string `xml:",innerxml"`
+	} `xml:"DAV: owner"`
+}
+
+// Returns a new opaque lock token.
+func newLockToken() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return fmt.Sprintf("opaquelocktoken:%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// Parses a Timeout header, such as "Second-600" or "Infinite", capped at
+// MAX_DAV_LOCK.
+func lockTimeout(header string) time.Duration {
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimSpace(t)
+		if seconds, err := strconv.Atoi(strings.TrimPrefix(t, "Second-")); err == nil &&
+			strings.HasPrefix(t, "Second-") {
+			if d := time.Duration(seconds) * time.Second; d < MAX_DAV_LOCK {
+				return d
+			}
+		}
+	}
+	return MAX_DAV_LOCK
+}
+
+// Takes out or refreshes an exclusive write lock. Locking a path that doesn't
+// exist yet creates an empty file there, as clients expect.
+func (d *davHandler) serveLock(w http.ResponseWriter, r *http.Request, p string, osPath string) {
+	body, _ := ioutil.ReadAll(io.LimitReader(r.Body, 1<<20))
+	timeout := lockTimeout(r.Header.Get("Timeout"))
+	davLocks.Lock()
+	lock := lockOn(p)
+	status := http.StatusOK
+	if len(bytes.TrimSpace(body)) == 0 {
+		// A refresh of a lock the client already holds.
+		if lock == nil || !strings.Contains(r.Header.Get("If"), lock.token) {
+			davLocks.Unlock()
+			http.Error(w, "No lock to refresh.", http.StatusPreconditionFailed)
+			return
+		}
+		lock.expires = time.Now().Add(timeout)
+	} else {
+		infinite := r.Header.Get("Depth") != "0"
+		conflict := lock != nil
+		for _, l := range davLocks.locks {
+			if infinite && strings.HasPrefix(l.path, p+"/") && time.Now().Before(l.expires) {
+				conflict = true
+			}
+		}
+		if conflict {
+			davLocks.Unlock()
+			http.Error(w, "Locked.", http.StatusLocked)
+			return
+		}
+		info := davLockInfo{}
+		if err := xml.Unmarshal(body, &info); err != nil {
+			davLocks.Unlock()
+			http.Error(w, "Invalid lock request.", http.StatusBadRequest)
+			return
+		}
+		lock = &davLock{token: newLockToken(), path: p, infinite: infinite,
+			owner: info.Owner.InnerXML, expires: time.Now().Add(timeout)}
+		davLocks.locks[lock.token] = lock
+		if _, err := os.Lstat(osPath); os.IsNotExist(err) {
+			if file, err := os.OpenFile(osPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644); err == nil {
+				file.Close()
+				status = http.StatusCreated
+			}
+		}
+	}
+	current := *lock
+	davLocks.Unlock()
+
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.Header().Set("Lock-Token", "<"+current.token+">")
+	w.WriteHeader(status)
+	fmt.Fprint(w, `<?xml version="1.0" encoding="utf-8"?><D:prop xmlns:D="DAV:"><D:lockdiscovery>`)
+	writeActiveLock(w, &current, d.href(p, false))
+	fmt.Fprint(w, "</D:lockdiscovery></D:prop>")
+}
+
+// Releases the lock named by the Lock-Token header.
+func (d *davHandler) serveUnlock(w http.ResponseWriter, r *http.Request, p string) {
+	token := strings.Trim(r.Header.Get("Lock-Token"), "<> ")
+	davLocks.Lock()
+	defer davLocks.Unlock()
+	if l, has := davLocks.locks[token]; has && l.covers(p) {
+		delete(davLocks.locks, token)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	http.Error(w, "No such lock.", http.StatusConflict)
+}
@@ -0,0 +1,79 @@
+package staticcontent
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Replaces the WebDAV locks with a test set for the rest of the test.
+func testDavLocks(t *testing.T) {
+	saved := davLocks.locks
+	t.Cleanup(func() { davLocks.locks = saved })
+	later, earlier := time.Now().Add(time.Hour), time.Now().Add(-time.Second)
+	davLocks.locks = map[string]*davLock{
+		"tok-file": {token: "tok-file", path: "/r/doc.txt", expires: later},
+		"tok-tree": {token: "tok-tree", path: "/r/tree", infinite: true, expires: later},
+		"tok-dir":  {token: "tok-dir", path: "/r/dir", expires: later},
+		"tok-deep": {token: "tok-deep", path: "/r/box/inner/note.txt", expires: later},
+		"tok-old":  {token: "tok-old", path: "/r/old.txt", expires: earlier},
+	}
+}
+
+func TestDavLocks(t *testing.T) {
+	testDavLocks(t)
+	tests := []struct {
+		p        string
+		ifHeader string
+		unlocked bool // For changes to p itself
+		tree     bool // For changes to p and everything below it
+	}{
+		{"/r/free.txt", "", true, true},
+		{"/r/doc.txt", "", false, false},
+		{"/r/doc.txt", "(<tok-file>)", true, true},
+		{"/r/doc.txt", "(<tok-tree>)", false, false},
+		{"/r/doc.txt.bak", "", true, true},
+
+		// Infinite locks cover everything below; others just the resource.
+		{"/r/tree/a/b.txt", "", false, false},
+		{"/r/tree/a/b.txt", "(<tok-tree>)", true, true},
+		{"/r/treehouse.txt", "", true, true},
+		{"/r/dir/a.txt", "", true, true},
+		{"/r/dir", "", false, false},
+
+		// Replacing a tree needs the tokens of locks within it.
+		{"/r/box", "", true, false},
+		{"/r/box/inner", "", true, false},
+		{"/r/box", "(<tok-deep>)", true, true},
+		{"/r", "(<tok-deep>)", true, false},
+
+		// Expired locks don't count.
+		{"/r/old.txt", "", true, true},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("PUT", DAV_PREFIX+test.p, nil)
+		if len(test.ifHeader) > 0 {
+			r.Header.Set("If", test.ifHeader)
+		}
+		if got := davUnlocked(r, test.p); got != test.unlocked {
+			t.Errorf("davUnlocked(%q, If %q) = %v; want %v", test.p, test.ifHeader, got, test.unlocked)
+		}
+		if got := davTreeUnlocked(r, test.p); got != test.tree {
+			t.Errorf("davTreeUnlocked(%q, If %q) = %v; want %v", test.p, test.ifHeader, got, test.tree)
+		}
+	}
+	if _, has := davLocks.locks["tok-old"]; has {
+		t.Error("Expired lock wasn't dropped")
+	}
+}
+
+func TestDropLocks(t *testing.T) {
+	testDavLocks(t)
+	dropLocks("/r/box")
+	dropLocks("/r/tree/a")
+	for token, want := range map[string]bool{"tok-deep": false, "tok-tree": true, "tok-file": true} {
+		if _, has := davLocks.locks[token]; has != want {
+			t.Errorf("After dropping, has %v = %v; want %v", token, has, want)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package staticcontent
+
+import (
+	"flag"
+	"net/http"
+	"strings"
+)
+
+var remux = flag.Bool("remux", true,
+	"When a client can play a video's codecs but not its container, copy the "+
+		"streams into a web-friendly container instead of transcoding them.")
+
+// The cookie the video player uses to report which formats the browser can
+// play, as a '.'-separated list of capability tokens (see capabilityProbes
+// in video.html.template).
+var CAPS_COOKIE = "sc_caps"
+
+// How a video is delivered to a client.
+type PlayMethod int
+
+const (
+	// Serve the file as-is.
+	DirectPlay PlayMethod = iota
+	// Copy the video stream into a new container, re-encoding the audio only
+	// if the client can't play it.
+	Remux
+	// Re-encode everything with a transcode profile.
+	Transcode
+)
+
+// The result of deciding how to serve a video to a particular client.
+type Decision struct {
+	Method    PlayMethod
+	Container string   // Container the client receives, e.g. "mp4" or "webm"
+	CopyAudio bool     // For Remux, whether the audio stream is copied as-is
+	Profile   *Profile // For Transcode, the profile to transcode with
+	Audio     *Stream  // The audio stream to play, or nil for the default
+}
+
+// The Content-Type of the stream the client will receive.
+func (d Decision) ContentType() string {
+	if d.Method == Transcode {
+		return d.Profile.ContentType
+	}
+	return "video/" + d.Container
+}
+
+// The Content-Type of the stream including codecs where known, for use as a
+// <source> type.
+func (d Decision) SourceType() string {
+	if d.Method == Transcode {
+		return d.Profile.SourceType()
+	}
+	return d.ContentType()
+}
+
+// The sc_mode value that serves this decision.
+func (d Decision) Mode() string {
+	switch d.Method {
+	case Remux:
+		return MODE_REMUX
+	case Transcode:
+		return MODE_TRANSCODE
+	}
+	return MODE_RAW
+}
+
+// The set of formats a client can play, as capability tokens: containers
+// ("mp4", "webm"), video codecs ("h264", "hevc", "vp8", "vp9", "av1") and audio
+// codecs ("aac", "mp3", "opus", "vorbis", "flac", "ac3").
+type ClientCaps map[string]bool
+
+// Whether the client supports every one of the given tokens.
+func (c ClientCaps) Can(tokens ...string) bool {
+	for _, t := range tokens {
+		if !c[t] {
+			return false
+		}
+	}
+	return true
+}
+
+// Whether the capabilities were reported by the browser itself, rather than
+// guessed from the User-Agent.
+func (c ClientCaps) Reported() bool {
+	return c["reported"]
+}
+
+func capsFrom(tokens ...string) ClientCaps {
+	c := ClientCaps{}
+	for _, t := range tokens {
+		c[t] = true
+	}
+	return c
+}
+
+// Determines what the requesting client can play. Capabilities reported by
+// the player page (via CAPS_COOKIE) take precedence; otherwise they're guessed
+// from the User-Agent.
+func ClientCapabilities(r *http.Request) ClientCaps {
+	if cookie, err := r.Cookie(CAPS_COOKIE); err == nil {
+		c := capsFrom(strings.Split(cookie.Value, ".")...)
+		c["reported"] = true
+		return c
+	}
+
+	ua := r.UserAgent()
+	switch {
+	case strings.Contains(ua, "iPhone"), strings.Contains(ua, "iPad"),
+		strings.Contains(ua, "Safari") && !strings.Contains(ua, "Chrome") &&
+			!strings.Contains(ua, "Chromium") && !strings.Contains(ua, "Android"):
+		return capsFrom("mp4", "h264", "hevc", "aac", "mp3", "ac3")
+	case strings.Contains(ua, "Chrome"), strings.Contains(ua, "Chromium"),
+		strings.Contains(ua, "Firefox"), strings.Contains(ua, "Edg/"):
+		return capsFrom("mp4", "webm", "h264", "vp8", "vp9", "aac", "mp3",
+			"opus", "vorbis")
+	}
+	// Unknown client; H.264/AAC in MP4 is the safest bet.
+	return capsFrom("mp4", "h264", "aac")
+}
+
+// Which container each extension we might play directly is.
+var directContainers = map[string]string{
+	"mp4":  "mp4",
+	"m4v":  "mp4",
+	"webm": "webm",
+}
+
+// Which codecs each web container can carry.
+var containerCodecs = map[string]map[string]bool{
+	"mp4":  {"h264": true, "hevc": true, "av1": true, "aac": true, "mp3": true},
+	"webm": {"vp8": true, "vp9": true, "av1": true, "opus": true, "vorbis": true},
+}
+
+// Decides how to serve the video with the given extension and probed info to
+// a client with caps, playing the given audio stream (nil for the default) and
+// transcoding with profile if nothing cheaper will do. If info is nil (the
+// file couldn't be probed), falls back to deciding by extension alone.
+func Decide(ext string, info *MediaInfo, audio *Stream, caps ClientCaps, profile *Profile) Decision {
+	ext = strings.ToLower(ext)
+	transcode := Decision{Method: Transcode, Profile: profile, Audio: audio,
+		Container: profile.ContentType[strings.Index(profile.ContentType, "/")+1:]}
+	if info == nil {
+		if container, has := directContainers[ext]; has && caps.Can(container) {
+			return Decision{Method: DirectPlay, Container: container}
+		}
+		return transcode
+	}
+
+	videoCodec, audioCodec := "", ""
+	if s := info.First("video"); s != nil {
+		videoCodec = s.CodecName
+	}
+	// Browsers only play the first audio stream of a file.
+	firstAudio := info.First("audio")
+	if audio == nil {
+		audio = firstAudio
+	}
+	if audio != nil {
+		audioCodec = audio.CodecName
+	}
+	playable := func(container, codec string) bool {
+		return codec == "" || (containerCodecs[container][codec] && caps.Can(codec))
+	}
+
+	if container, has := directContainers[ext]; has && caps.Can(container) &&
+		playable(container, videoCodec) && playable(container, audioCodec) &&
+		(audio == nil || audio.Index == firstAudio.Index) {
+		return Decision{Method: DirectPlay, Container: container}
+	}
+
+	if *remux && videoCodec != "" {
+		for _, container := range []string{"mp4", "webm"} {
+			if !caps.Can(container) || !playable(container, videoCodec) {
+				continue
+			}
+			return Decision{Method: Remux, Container: container, Audio: audio,
+				CopyAudio: playable(container, audioCodec)}
+		}
+	}
+	return transcode
+}
+
+// Returns the transcoder arguments (after the input) that remux a file as
+// described by d, writing the result to stdout.
+func remuxArgs(d Decision) []string {
+	args := []string{"-map", "0:v:0", "-map", "0:a:0?"}
+	if d.Audio != nil {
+		args = audioMapArgs(d.Audio)
+	}
+	args = append(args, "-sn", "-c:v", "copy")
+	if d.CopyAudio {
+		args = append(args, "-c:a", "copy")
+	} else if d.Container == "webm" {
+		args = append(args, "-c:a", "libopus", "-b:a", "128k")
+	} else {
+		args = append(args, "-c:a", "aac", "-b:a", "192k")
+	}
+	if d.Container == "mp4" {
+		// MP4 can only be streamed to a pipe when fragmented.
+		return append(args, outputFormats[FORMAT_FMP4].args...)
+	}
+	return append(args, outputFormats[FORMAT_WEBM].args...)
+}
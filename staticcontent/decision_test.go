@@ -0,0 +1,78 @@
+package staticcontent
+
+import (
+	"testing"
+)
+
+// Returns probe results for a file with the given video and audio codecs; ""
+// leaves a stream out.
+func testMedia(video string, audio ...string) *MediaInfo {
+	info := &MediaInfo{}
+	if len(video) > 0 {
+		info.Streams = append(info.Streams, Stream{Index: 0, CodecType: "video", CodecName: video})
+	}
+	for _, codec := range audio {
+		info.Streams = append(info.Streams, Stream{Index: len(info.Streams),
+			CodecType: "audio", CodecName: codec})
+	}
+	return info
+}
+
+func TestDecide(t *testing.T) {
+	chrome := capsFrom("mp4", "webm", "h264", "vp8", "vp9", "aac", "mp3", "opus", "vorbis")
+	safari := capsFrom("mp4", "h264", "hevc", "aac", "mp3", "ac3")
+	profile := &Profile{Name: "test", ContentType: "video/webm"}
+	twoAudio := testMedia("h264", "aac", "mp3")
+	tests := []struct {
+		ext       string
+		info      *MediaInfo
+		audio     *Stream
+		caps      ClientCaps
+		noRemux   bool
+		method    PlayMethod
+		container string
+		copyAudio bool
+	}{
+		// Playable as-is.
+		{"mp4", testMedia("h264", "aac"), nil, chrome, false, DirectPlay, "mp4", false},
+		{"M4V", testMedia("h264", "aac"), nil, safari, false, DirectPlay, "mp4", false},
+		{"webm", testMedia("vp9", "opus"), nil, chrome, false, DirectPlay, "webm", false},
+		{"mp4", testMedia("hevc", "aac"), nil, safari, false, DirectPlay, "mp4", false},
+		{"mp4", testMedia("h264"), nil, chrome, false, DirectPlay, "mp4", false},
+
+		// Unknown codecs fall back to the extension.
+		{"mp4", nil, nil, chrome, false, DirectPlay, "mp4", false},
+		{"webm", nil, nil, safari, false, Transcode, "webm", false},
+		{"mkv", nil, nil, chrome, false, Transcode, "webm", false},
+
+		// Playable codecs in another container are remuxed, re-encoding the
+		// audio only if needed.
+		{"mkv", testMedia("h264", "aac"), nil, chrome, false, Remux, "mp4", true},
+		{"mkv", testMedia("h264", "ac3"), nil, chrome, false, Remux, "mp4", false},
+		{"mp4", testMedia("h264", "ac3"), nil, chrome, false, Remux, "mp4", false},
+		{"mkv", testMedia("vp9", "opus"), nil, chrome, false, Remux, "webm", true},
+		{"mkv", testMedia("vp9", "aac"), nil, chrome, false, Remux, "webm", false},
+		{"mkv", testMedia("h264", "aac"), nil, chrome, true, Transcode, "webm", false},
+
+		// Only the first audio stream plays directly.
+		{"mp4", twoAudio, &twoAudio.Streams[2], safari, false, Remux, "mp4", true},
+		{"mp4", twoAudio, &twoAudio.Streams[1], safari, false, DirectPlay, "mp4", false},
+
+		// Unplayable video is transcoded.
+		{"mkv", testMedia("hevc", "aac"), nil, chrome, false, Transcode, "webm", false},
+		{"mkv", testMedia("vp9", "opus"), nil, safari, false, Transcode, "webm", false},
+		{"avi", testMedia("mpeg4", "mp3"), nil, chrome, false, Transcode, "webm", false},
+	}
+	defer func(saved bool) { *remux = saved }(*remux)
+	for i, test := range tests {
+		*remux = !test.noRemux
+		d := Decide(test.ext, test.info, test.audio, test.caps, profile)
+		if d.Method != test.method || d.Container != test.container || d.CopyAudio != test.copyAudio {
+			t.Errorf("Case %v: Decide(%q) = method %v in %q, copying audio %v; want method %v in %q, copying audio %v",
+				i, test.ext, d.Method, d.Container, d.CopyAudio, test.method, test.container, test.copyAudio)
+		}
+		if test.method == Transcode && d.Profile != profile {
+			t.Errorf("Case %v: Decide(%q) transcodes with %v; want %v", i, test.ext, d.Profile, profile)
+		}
+	}
+}
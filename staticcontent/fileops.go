@@ -0,0 +1,518 @@
+package staticcontent
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/EricBurnett/WebCmd/platform"
+	"github.com/EricBurnett/WebCmd/resources"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+var trash_retention = flag.Duration("trash_retention", 30*24*time.Hour,
+	"How long deleted files are kept in a writable root's trash before being "+
+		"purged. If 0, they're kept until restored or removed by hand.")
+
+var (
+	// File operations on writable roots, POSTed to the file or directory they
+	// act on. MODE_MKDIR creates the folder PARAM_NAME in a directory,
+	// MODE_RENAME renames to PARAM_NAME, MODE_MOVE moves into the directory
+	// PARAM_DEST (possibly in another root) and MODE_DELETE moves to the
+	// root's trash.
+	MODE_MKDIR  = "mkdir"
+	MODE_RENAME = "rename"
+	MODE_MOVE   = "move"
+	MODE_DELETE = "delete"
+	// Shows a root's trash, and restores PARAM_ITEM from it.
+	MODE_TRASH   = "trash"
+	MODE_RESTORE = "restore"
+
+	// A directory's URL path, e.g. "/static_root/videos/old/".
+	PARAM_DEST = "sc_dest"
+	PARAM_ITEM = "sc_item"
+)
+
+// Name of the directory in each writable root that deleted files are kept in.
+var trashDirName = ".webcmd-trash"
+
+// Name of the file recording where a trash item came from.
+var trashInfoName = "info.json"
+
+var errReadOnly = errors.New("This root is read-only.")
+
+// Returns name as the filesystem compares it; see platform.CanonicalName.
+// Swapped out by tests.
+var canonicalName = platform.CanonicalName
+
+// Whether name is one of the files we keep in roots for our own use, which
+// are hidden from clients. Names are compared as the filesystem does, so
+// other spellings of them are hidden too.
+func isInternalName(name string) bool {
+	name = canonicalName(name)
+	return name == trashDirName || strings.HasPrefix(name, partialUploadPrefix)
+}
+
+// A deleted file or directory, kept in the trash of its root.
+type TrashItem struct {
+	Id      string    `json:"-"`
+	Root    string    `json:"-"`       // URL path of the root
+	Path    string    `json:"path"`    // Slash-separated path it was deleted from
+	Deleted time.Time `json:"deleted"` // When it was deleted
+}
+
+// The URL path the item will be restored to.
+func (t TrashItem) Url() string {
+	return t.Root + t.Path
+}
+
+// Returns the handler for the root containing urlPath, and the OS path it
+// refers to. Paths are confined to the root as for requests.
+func (server *Server) resolve(urlPath string) (*FileHandler, string, error) {
+	var f *FileHandler
+	for prefix, h := range server.handlers {
+		if (strings.HasPrefix(urlPath, prefix) || urlPath+"/" == prefix) &&
+			(f == nil || len(prefix) > len(f.PathPrefix)) {
+			f = h
+		}
+	}
+	if f == nil {
+		return nil, "", errors.New("Not in any static content root: " + urlPath)
+	}
+	p, err := f.osPath(strings.TrimPrefix(urlPath, strings.TrimSuffix(f.PathPrefix, "/")))
+	return f, p, err
+}
+
+// Like resolve, but only for existing files and directories within a writable
+// root, excluding the root itself.
+func (server *Server) resolveWritable(urlPath string) (*FileHandler, string, error) {
+	f, p, err := server.resolve(urlPath)
+	if err != nil {
+		return nil, "", err
+	}
+	if !f.Options.Writable {
+		return nil, "", errReadOnly
+	}
+	if p == filepath.Clean(f.OSPath) {
+		return nil, "", errors.New("Roots themselves can't be changed.")
+	}
+	if _, err := os.Lstat(p); err != nil {
+		return nil, "", errors.New("No such file: " + urlPath)
+	}
+	return f, p, nil
+}
+
+// Returns the OS path of an existing directory in a writable root.
+func (server *Server) writableDir(urlPath string) (*FileHandler, string, error) {
+	f, p, err := server.resolve(urlPath)
+	if err != nil {
+		return nil, "", err
+	}
+	if !f.Options.Writable {
+		return nil, "", errReadOnly
+	}
+	if stat, err := os.Stat(p); err != nil || !stat.IsDir() {
+		return nil, "", errors.New("No such folder: " + urlPath)
+	}
+	return f, p, nil
+}
+
+// Creates the folder name in the directory dir (both URL paths), returning
+// its URL path.
+func (server *Server) Mkdir(dir string, name string) (string, error) {
+	if err := validName(name); err != nil {
+		return "", err
+	}
+	_, p, err := server.writableDir(dir)
+	if err != nil {
+		return "", err
+	}
+	log.Println("Creating folder", filepath.Join(p, name))
+	if err := os.Mkdir(filepath.Join(p, name), 0755); err != nil {
+		return "", err
+	}
+	return path.Join(dir, name) + "/", nil
+}
+
+// Renames the file or directory at urlPath to name, in the same directory.
+// Returns its new URL path.
+func (server *Server) Rename(urlPath string, name string) (string, error) {
+	if err := validName(name); err != nil {
+		return "", err
+	}
+	_, p, err := server.resolveWritable(urlPath)
+	if err != nil {
+		return "", err
+	}
+	target := filepath.Join(filepath.Dir(p), name)
+	if existing, err := os.Lstat(target); err == nil {
+		// On case-insensitive filesystems, changing case finds the file itself.
+		if stat, err := os.Lstat(p); err != nil || !os.SameFile(stat, existing) {
+			return "", errors.New("Already exists: " + name)
+		}
+	}
+	log.Println("Renaming", p, "to", target)
+	if err := os.Rename(p, target); err != nil {
+		return "", err
+	}
+	return path.Join(path.Dir(strings.TrimSuffix(urlPath, "/")), name), nil
+}
+
+// Moves the file or directory at urlPath into the directory dest, which may
+// be in another writable root. Returns its new URL path.
+func (server *Server) Move(urlPath string, dest string) (string, error) {
+	from, p, err := server.resolveWritable(urlPath)
+	if err != nil {
+		return "", err
+	}
+	to, destPath, err := server.writableDir(dest)
+	if err != nil {
+		return "", err
+	}
+	target := filepath.Join(destPath, filepath.Base(p))
+	if target == p {
+		return "", errors.New("Already in " + dest)
+	}
+	if strings.HasPrefix(destPath+string(filepath.Separator), p+string(filepath.Separator)) {
+		return "", errors.New("Can't move a folder into itself.")
+	}
+	if _, err := os.Lstat(target); err == nil {
+		return "", errors.New("Already exists: " + path.Join(dest, filepath.Base(p)))
+	}
+	log.Println("Moving", p, "to", target)
+	if err := moveFile(from, p, target, from != to); err != nil {
+		return "", err
+	}
+	return path.Join(dest, filepath.Base(p)), nil
+}
+
+// Moves src, in root f, to dst. If acrossRoots, a failed rename (e.g.
+// because the roots are on different drives) falls back to copying and
+// removing the original, which is refused if the tree holds entries f hides.
+func moveFile(f *FileHandler, src string, dst string, acrossRoots bool) error {
+	err := os.Rename(src, dst)
+	if err == nil || !acrossRoots {
+		return err
+	}
+	hidden, err := f.hidesWithin(src)
+	if err != nil {
+		return err
+	}
+	if hidden {
+		return errors.New("Can't move a folder holding hidden files to another drive.")
+	}
+	if err := f.copyTree(src, dst); err != nil {
+		os.RemoveAll(dst)
+		return err
+	}
+	return os.RemoveAll(src)
+}
+
+// Copies the file or directory tree at src, in root f, to dst, keeping modes
+// and modification times. Only entries f lists are copied, so hidden, ignored
+// and our own files stay behind.
+func (f *FileHandler) copyTree(src string, dst string) error {
+	info, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+	switch {
+	case info.IsDir():
+		if err := os.Mkdir(dst, info.Mode().Perm()); err != nil {
+			return err
+		}
+		files, err := f.listDir(src)
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			if err := f.copyTree(filepath.Join(src, file.Name()), filepath.Join(dst, file.Name())); err != nil {
+				return err
+			}
+		}
+	case info.Mode()&os.ModeSymlink != 0:
+		link, err := os.Readlink(src)
+		if err != nil {
+			return err
+		}
+		return os.Symlink(link, dst)
+	default:
+		in, err := os.Open(src)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(out, in)
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return os.Chtimes(dst, info.ModTime(), info.ModTime())
+}
+
+// Returns whether the tree at p, in root f, holds anything f doesn't list.
+func (f *FileHandler) hidesWithin(p string) (bool, error) {
+	info, err := os.Lstat(p)
+	if err != nil || !info.IsDir() {
+		return false, err
+	}
+	all, err := ioutil.ReadDir(p)
+	if err != nil {
+		return false, err
+	}
+	files, err := f.listDir(p)
+	if err != nil {
+		return false, err
+	}
+	if len(files) != len(all) {
+		return true, nil
+	}
+	for _, file := range files {
+		if hidden, err := f.hidesWithin(filepath.Join(p, file.Name())); hidden || err != nil {
+			return hidden, err
+		}
+	}
+	return false, nil
+}
+
+// Returns the OS path of the trash directory of a root.
+func (f *FileHandler) trashDir() string {
+	return filepath.Join(f.OSPath, trashDirName)
+}
+
+// Moves the file or directory at urlPath to its root's trash.
+func (server *Server) Delete(urlPath string) (TrashItem, error) {
+	f, p, err := server.resolveWritable(urlPath)
+	if err != nil {
+		return TrashItem{}, err
+	}
+	rel, err := filepath.Rel(filepath.Clean(f.OSPath), p)
+	if err != nil {
+		return TrashItem{}, err
+	}
+	item := TrashItem{Id: fmt.Sprint(time.Now().UnixNano()), Root: f.PathPrefix,
+		Path: filepath.ToSlash(rel), Deleted: time.Now()}
+	itemDir := filepath.Join(f.trashDir(), item.Id)
+	if err := os.MkdirAll(itemDir, 0755); err != nil {
+		return item, err
+	}
+	info, err := json.Marshal(item)
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(itemDir, trashInfoName), info, 0644)
+	}
+	if err == nil {
+		log.Println("Moving", p, "to trash as", item.Id)
+		err = os.Rename(p, filepath.Join(itemDir, filepath.Base(p)))
+	}
+	if err != nil {
+		os.RemoveAll(itemDir)
+	}
+	return item, err
+}
+
+// Reads the trash item id of the root served by f.
+func (f *FileHandler) trashItem(id string) (TrashItem, error) {
+	item := TrashItem{Id: id, Root: f.PathPrefix}
+	if err := validName(id); err != nil {
+		return item, err
+	}
+	info, err := ioutil.ReadFile(filepath.Join(f.trashDir(), id, trashInfoName))
+	if err != nil {
+		return item, errors.New("No such item in the trash: " + id)
+	}
+	err = json.Unmarshal(info, &item)
+	return item, err
+}
+
+// Lists the trash of the root served by f, most recently deleted first.
+func (f *FileHandler) trashItems() []TrashItem {
+	items := []TrashItem{}
+	dirs, err := ioutil.ReadDir(f.trashDir())
+	if err != nil {
+		return items
+	}
+	for _, dir := range dirs {
+		if item, err := f.trashItem(dir.Name()); err == nil {
+			items = append(items, item)
+		}
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].Deleted.After(items[j].Deleted)
+	})
+	return items
+}
+
+// Returns the root installed at the URL path root.
+func (server *Server) root(root string) (*FileHandler, error) {
+	if !strings.HasSuffix(root, "/") {
+		root += "/"
+	}
+	f, has := server.handlers[root]
+	if !has {
+		return nil, errors.New("No such root: " + root)
+	}
+	return f, nil
+}
+
+// Lists the trash of the writable root at the URL path root.
+func (server *Server) Trash(root string) ([]TrashItem, error) {
+	f, err := server.root(root)
+	if err != nil {
+		return nil, err
+	}
+	if !f.Options.Writable {
+		return nil, errReadOnly
+	}
+	return f.trashItems(), nil
+}
+
+// Restores an item from the trash of the root at the URL path root to where
+// it was deleted from, under a new name if that's since been taken. Returns
+// its URL path.
+func (server *Server) Restore(root string, id string) (string, error) {
+	f, err := server.root(root)
+	if err != nil {
+		return "", err
+	}
+	if !f.Options.Writable {
+		return "", errReadOnly
+	}
+	item, err := f.trashItem(id)
+	if err != nil {
+		return "", err
+	}
+	p, err := f.osPath(item.Path)
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Dir(p)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	name := freeName(dir, filepath.Base(p))
+	itemDir := filepath.Join(f.trashDir(), id)
+	log.Println("Restoring", id, "from trash to", filepath.Join(dir, name))
+	if err := os.Rename(filepath.Join(itemDir, filepath.Base(p)), filepath.Join(dir, name)); err != nil {
+		return "", err
+	}
+	os.RemoveAll(itemDir)
+	return path.Join(f.PathPrefix, path.Dir(item.Path), name), nil
+}
+
+// Permanently removes trash items older than --trash_retention from all
+// writable roots.
+func (server *Server) PurgeTrash() {
+	if *trash_retention <= 0 {
+		return
+	}
+	for _, f := range server.handlers {
+		if !f.Options.Writable {
+			continue
+		}
+		for _, item := range f.trashItems() {
+			if time.Since(item.Deleted) > *trash_retention {
+				log.Println("Purging", item.Url(), "from trash")
+				if err := os.RemoveAll(filepath.Join(f.trashDir(), item.Id)); err != nil {
+					log.Println("Unable to purge trash item:", err)
+				}
+			}
+		}
+	}
+}
+
+// Purges old trash items, abandoned uploads, unused thumbnails and extracted
+// archive members now, then hourly, in the background.
+func (server *Server) StartPurging() {
+	go func() {
+		for {
+			server.PurgeTrash()
+			server.PurgeUploads()
+			PurgeThumbnails()
+			PurgeArchiveCache()
+			time.Sleep(time.Hour)
+		}
+	}()
+}
+
+// Handler for the file operations POSTed to files and directories. Responds
+// with the new URL path of the file as JSON.
+func (f *FileHandler) ServeFileOp(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "File operations must be POSTed.", http.StatusMethodNotAllowed)
+		return
+	}
+	if !SameOrigin(r) {
+		http.Error(w, errCrossSite.Error(), http.StatusForbidden)
+		return
+	}
+	query := r.URL.Query()
+	urlPath := f.PathPrefix + r.URL.Path
+	var result string
+	var err error
+	switch query.Get(PARAM_MODE) {
+	case MODE_MKDIR:
+		result, err = f.server.Mkdir(urlPath, query.Get(PARAM_NAME))
+	case MODE_RENAME:
+		result, err = f.server.Rename(urlPath, query.Get(PARAM_NAME))
+	case MODE_MOVE:
+		result, err = f.server.Move(urlPath, query.Get(PARAM_DEST))
+	case MODE_DELETE:
+		var item TrashItem
+		item, err = f.server.Delete(urlPath)
+		result = item.Url()
+	case MODE_RESTORE:
+		result, err = f.server.Restore(f.PathPrefix, query.Get(PARAM_ITEM))
+	}
+	if err == errReadOnly {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, map[string]string{"url": result})
+}
+
+var TRASH_TEMPLATE_FILE = "templates/trash.html.template"
+
+type trashData struct {
+	Root  string
+	Items []TrashItem
+}
+
+// Serves a page listing the root's trash, with buttons to restore each item.
+func (f *FileHandler) ServeTrash(w http.ResponseWriter, r *http.Request) {
+	if !f.Options.Writable {
+		http.Error(w, errReadOnly.Error(), http.StatusForbidden)
+		return
+	}
+	template_content, err := resources.Load(TRASH_TEMPLATE_FILE)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var trashTemplate = template.New("Trash template")
+	trashTemplate, err = trashTemplate.Parse(string(template_content))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	trashTemplate.Execute(w, &trashData{Root: f.PathPrefix, Items: f.trashItems()})
+}
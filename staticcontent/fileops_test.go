@@ -0,0 +1,48 @@
+package staticcontent
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// Copies leave behind whatever the root hides.
+func TestCopyTreeSkipsHidden(t *testing.T) {
+	root, _ := testRoot(t)
+	src := filepath.Join(root, "sub")
+	for _, name := range []string{".secret", "skip.tmp", partialUploadPrefix + "x"} {
+		if err := ioutil.WriteFile(filepath.Join(src, name), []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f := &FileHandler{OSPath: root, Options: RootOptions{HideDotfiles: true, Ignore: []string{"*.tmp"}}}
+	if hidden, err := f.hidesWithin(src); err != nil || !hidden {
+		t.Errorf("hidesWithin = %v, %v; want true", hidden, err)
+	}
+	dst := filepath.Join(t.TempDir(), "copy")
+	if err := f.copyTree(src, dst); err != nil {
+		t.Fatal(err)
+	}
+	files, err := ioutil.ReadDir(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, file := range files {
+		names = append(names, file.Name())
+	}
+	sort.Strings(names)
+	if strings.Join(names, ",") != "b.txt" {
+		t.Errorf("Copied %v; want [b.txt]", names)
+	}
+
+	os.Remove(filepath.Join(src, ".secret"))
+	os.Remove(filepath.Join(src, "skip.tmp"))
+	os.Remove(filepath.Join(src, partialUploadPrefix+"x"))
+	if hidden, err := f.hidesWithin(src); err != nil || hidden {
+		t.Errorf("hidesWithin after cleaning up = %v, %v; want false", hidden, err)
+	}
+}
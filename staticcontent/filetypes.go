@@ -0,0 +1,88 @@
+package staticcontent
+
+import (
+	"mime"
+	"path/filepath"
+	"strings"
+)
+
+// Broad kinds of file, for icons and search filters.
+const (
+	KIND_DIR     = "dir"
+	KIND_VIDEO   = "video"
+	KIND_AUDIO   = "audio"
+	KIND_IMAGE   = "image"
+	KIND_DOC     = "doc"
+	KIND_ARCHIVE = "archive"
+	KIND_OTHER   = "other"
+)
+
+// Extensions (lowercase, without the dot) of files we treat as videos.
+var videoExtensions = map[string]bool{
+	"mp4": true, "m4v": true, "webm": true, "mkv": true, "avi": true,
+	"wmv": true, "mov": true,
+}
+
+// Extensions of images we can decode and scale ourselves.
+var imageExtensions = map[string]bool{
+	"jpg": true, "jpeg": true, "png": true, "gif": true,
+}
+
+// Extensions of the other kinds of file.
+var kindExtensions = map[string]map[string]bool{
+	KIND_AUDIO: {"mp3": true, "flac": true, "ogg": true, "oga": true,
+		"opus": true, "m4a": true, "aac": true, "wav": true, "wma": true},
+	KIND_IMAGE: {"bmp": true, "webp": true, "tif": true, "tiff": true,
+		"svg": true, "heic": true},
+	KIND_DOC: {"txt": true, "md": true, "pdf": true, "doc": true,
+		"docx": true, "odt": true, "rtf": true, "csv": true, "html": true,
+		"htm": true, "xls": true, "xlsx": true, "ppt": true, "pptx": true},
+	KIND_ARCHIVE: {"zip": true, "tar": true, "gz": true, "tgz": true,
+		"bz2": true, "xz": true, "7z": true, "rar": true},
+}
+
+// Returns the lowercase extension of name, without the dot.
+func extension(name string) string {
+	return strings.ToLower(strings.TrimPrefix(filepath.Ext(name), "."))
+}
+
+// Whether name looks like a video.
+func IsVideo(name string) bool {
+	return videoExtensions[extension(name)]
+}
+
+// Whether name looks like an audio file.
+func IsAudio(name string) bool {
+	return kindExtensions[KIND_AUDIO][extension(name)]
+}
+
+// Whether name looks like an image we can thumbnail.
+func IsImage(name string) bool {
+	return imageExtensions[extension(name)]
+}
+
+// Returns which KIND_ of file name is, judging by its extension.
+func FileKind(name string) string {
+	ext := extension(name)
+	switch {
+	case videoExtensions[ext]:
+		return KIND_VIDEO
+	case imageExtensions[ext]:
+		return KIND_IMAGE
+	}
+	for kind, extensions := range kindExtensions {
+		if extensions[ext] {
+			return kind
+		}
+	}
+	return KIND_OTHER
+}
+
+// Returns the MIME type of name, judging by its extension.
+func mimeType(name string) string {
+	contentType := mime.TypeByExtension(filepath.Ext(name))
+	if len(contentType) == 0 {
+		contentType = "application/octet-stream"
+	}
+	return contentType
+}
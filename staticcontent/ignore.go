@@ -0,0 +1,107 @@
+package staticcontent
+
+import (
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Whether the slash-separated path rel, within the root, is hidden by the
+// root's ignore rules: its hide_dotfiles option and ignore patterns. As with
+// .gitignore, everything inside an ignored directory is ignored too. isDir
+// says whether rel itself is a directory; its parents always are.
+func (f *FileHandler) ignored(rel string, isDir bool) bool {
+	if !f.Options.HideDotfiles && len(f.Options.Ignore) == 0 {
+		return false
+	}
+	parts := strings.Split(strings.Trim(rel, "/"), "/")
+	for i, part := range parts {
+		if len(part) == 0 {
+			continue
+		}
+		if f.Options.HideDotfiles && strings.HasPrefix(part, ".") {
+			return true
+		}
+		if matchIgnore(f.Options.Ignore, strings.Join(parts[:i+1], "/"), isDir || i < len(parts)-1) {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether the gitignore-style patterns ignore the slash-separated path rel
+// (without considering its parents). Patterns without a slash match the name
+// at any depth; others match the whole path from the root, with "**"
+// matching any number of directories. A trailing slash only matches
+// directories, and a leading "!" re-includes what earlier patterns ignored.
+// Names are compared as the filesystem does, so where it ignores case, so do
+// patterns.
+func matchIgnore(patterns []string, rel string, isDir bool) bool {
+	segments := strings.Split(rel, "/")
+	for i := range segments {
+		segments[i] = canonicalName(segments[i])
+	}
+	rel = strings.Join(segments, "/")
+	ignored := false
+	for _, pattern := range patterns {
+		negate := strings.HasPrefix(pattern, "!")
+		pattern = strings.TrimPrefix(pattern, "!")
+		if strings.HasSuffix(pattern, "/") {
+			if !isDir {
+				continue
+			}
+			pattern = strings.TrimSuffix(pattern, "/")
+		}
+		parts := strings.Split(pattern, "/")
+		for i := range parts {
+			parts[i] = canonicalName(parts[i])
+		}
+		pattern = strings.Join(parts, "/")
+		var matched bool
+		if strings.Contains(pattern, "/") {
+			matched = matchGlob(strings.Split(strings.TrimPrefix(pattern, "/"), "/"),
+				strings.Split(rel, "/"))
+		} else {
+			matched, _ = path.Match(pattern, path.Base(rel))
+		}
+		if matched {
+			ignored = !negate
+		}
+	}
+	return ignored
+}
+
+// Matches path segments against pattern segments, where "**" matches zero or
+// more segments and others are as for path.Match.
+func matchGlob(pattern []string, segments []string) bool {
+	if len(pattern) == 0 {
+		return len(segments) == 0
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(segments); i++ {
+			if matchGlob(pattern[1:], segments[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(segments) == 0 {
+		return false
+	}
+	if ok, _ := path.Match(pattern[0], segments[0]); !ok {
+		return false
+	}
+	return matchGlob(pattern[1:], segments[1:])
+}
+
+// Like ignored, for an OS path inside the root.
+func (f *FileHandler) ignoredPath(p string, isDir bool) bool {
+	if !f.Options.HideDotfiles && len(f.Options.Ignore) == 0 {
+		return false
+	}
+	rel, err := filepath.Rel(filepath.Clean(f.OSPath), p)
+	if err != nil || rel == "." {
+		return false
+	}
+	return f.ignored(filepath.ToSlash(rel), isDir)
+}
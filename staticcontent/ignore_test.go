@@ -0,0 +1,119 @@
+package staticcontent
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMatchIgnore(t *testing.T) {
+	tests := []struct {
+		patterns []string
+		rel      string
+		isDir    bool
+		want     bool
+	}{
+		{[]string{"*.tmp"}, "a.tmp", false, true},
+		{[]string{"*.tmp"}, "deep/down/a.tmp", false, true},
+		{[]string{"*.tmp"}, "a.tmp.txt", false, false},
+		{[]string{"Thumbs.db"}, "photos/Thumbs.db", false, true},
+
+		// Trailing slashes only match directories.
+		{[]string{"build/"}, "build", true, true},
+		{[]string{"build/"}, "build", false, false},
+
+		// Patterns with a slash are anchored at the root.
+		{[]string{"/private"}, "private", true, true},
+		{[]string{"/private"}, "sub/private", true, false},
+		{[]string{"docs/*.pdf"}, "docs/a.pdf", false, true},
+		{[]string{"docs/*.pdf"}, "other/docs/a.pdf", false, false},
+		{[]string{"**/cache"}, "cache", true, true},
+		{[]string{"**/cache"}, "a/b/cache", true, true},
+		{[]string{"logs/**/*.log"}, "logs/x.log", false, true},
+		{[]string{"logs/**/*.log"}, "logs/a/b/x.log", false, true},
+		{[]string{"logs/**/*.log"}, "x.log", false, false},
+
+		// Later patterns win, and "!" re-includes.
+		{[]string{"*.log", "!keep.log"}, "keep.log", false, false},
+		{[]string{"*.log", "!keep.log"}, "drop.log", false, true},
+		{[]string{"!keep.log", "*.log"}, "keep.log", false, true},
+
+		{nil, "anything", false, false},
+	}
+	for _, test := range tests {
+		if got := matchIgnore(test.patterns, test.rel, test.isDir); got != test.want {
+			t.Errorf("matchIgnore(%q, %q, %v) = %v; want %v", test.patterns, test.rel, test.isDir, got, test.want)
+		}
+	}
+}
+
+// Where the filesystem ignores case, so do ignore patterns.
+func TestMatchIgnoreFoldsCase(t *testing.T) {
+	defer func(saved func(string) string) { canonicalName = saved }(canonicalName)
+	canonicalName = strings.ToLower
+	tests := []struct {
+		patterns []string
+		rel      string
+		want     bool
+	}{
+		{[]string{"Thumbs.db"}, "THUMBS.DB", true},
+		{[]string{"*.TMP"}, "a.tmp", true},
+		{[]string{"/Private/*.txt"}, "PRIVATE/notes.TXT", true},
+		{[]string{"*.log", "!Keep.log"}, "KEEP.LOG", false},
+	}
+	for _, test := range tests {
+		if got := matchIgnore(test.patterns, test.rel, false); got != test.want {
+			t.Errorf("matchIgnore(%q, %q) = %v; want %v", test.patterns, test.rel, got, test.want)
+		}
+	}
+}
+
+func TestIgnored(t *testing.T) {
+	f := &FileHandler{Options: RootOptions{HideDotfiles: true, Ignore: []string{"cache/", "*.part"}}}
+	tests := []struct {
+		rel   string
+		isDir bool
+		want  bool
+	}{
+		{"a.txt", false, false},
+		{".hidden", false, true},
+		{"sub/.git/config", false, true},
+		{"cache", true, true},
+		{"cache/inside.txt", false, true},
+		{"cache", false, false},
+		{"movie.mkv.part", false, true},
+	}
+	for _, test := range tests {
+		if got := f.ignored(test.rel, test.isDir); got != test.want {
+			t.Errorf("ignored(%q, %v) = %v; want %v", test.rel, test.isDir, got, test.want)
+		}
+	}
+}
+
+// Directory patterns hide symlinks to directories in listings too.
+func TestListDirIgnoresLinkedDirectories(t *testing.T) {
+	root := t.TempDir()
+	if err := os.Mkdir(filepath.Join(root, "real"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "file"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(root, "real"), filepath.Join(root, "linked")); err != nil {
+		t.Skip("Symlinks unsupported:", err)
+	}
+	f := &FileHandler{OSPath: root, Options: RootOptions{Ignore: []string{"linked/", "file/"}}}
+	files, err := f.listDir(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, file := range files {
+		names = append(names, file.Name())
+	}
+	if strings.Join(names, ",") != "file,real" {
+		t.Errorf("listDir = %v; want [file real]", names)
+	}
+}
@@ -0,0 +1,320 @@
+package staticcontent
+
+import (
+	"errors"
+	"flag"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var index_interval = flag.Duration("index_interval", 5*time.Minute,
+	"How often to rescan static content roots for the file search index. "+
+		"Only directories that changed since the last scan are re-read; files "+
+		"in the rest are just re-statted. If 0, files are never indexed.")
+
+// Maximum number of results a search returns.
+var MAX_SEARCH_RESULTS = 100
+
+// A file or directory in the search index.
+type IndexEntry struct {
+	Root    string // URL path of the root it's in, e.g. "/static_root/videos/"
+	RelPath string // Slash-separated path within the root
+	Name    string
+	Size    int64
+	ModTime time.Time
+	IsDir   bool
+	Kind    string // One of the KIND_ constants
+}
+
+// The URL the entry is served at.
+func (e IndexEntry) Url() string {
+	u := e.Root + escapePath(e.RelPath)
+	if e.IsDir {
+		u += "/"
+	}
+	return u
+}
+
+// The contents of one directory, as of its last modification time.
+type indexedDir struct {
+	modTime time.Time
+	entries []IndexEntry
+}
+
+// A name/path index over all the roots of a Server. Rescans are incremental:
+// a directory is only re-read if its modification time changed, which is the
+// case whenever entries are added to, removed from or renamed within it.
+// Files edited in place don't change it, so the files of unchanged
+// directories are re-statted instead.
+type Index struct {
+	lock  sync.RWMutex
+	roots map[string]*FileHandler // Handler of each root, by URL path
+	dirs  map[string]*indexedDir  // OS path of each directory -> contents
+	text  *TextIndex              // Index of file contents, if enabled
+}
+
+// Returns an empty Index.
+func NewIndex() *Index {
+	return &Index{roots: make(map[string]*FileHandler), dirs: make(map[string]*indexedDir)}
+}
+
+// Adds a root to be indexed on the next scan.
+func (idx *Index) AddRoot(f *FileHandler) {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+	idx.roots[f.PathPrefix] = f
+}
+
+// Scans every root now, then again every --index_interval, forever.
+func (idx *Index) Run() {
+	if *index_interval <= 0 {
+		log.Println("File indexing disabled.")
+		return
+	}
+	if *text_index {
+		text := LoadTextIndex()
+		idx.lock.Lock()
+		idx.text = text
+		idx.lock.Unlock()
+	}
+	for {
+		start := time.Now()
+		idx.Scan()
+		log.Println("Indexed static content in", time.Since(start))
+		time.Sleep(*index_interval)
+	}
+}
+
+// Brings the index up to date with the filesystem.
+func (idx *Index) Scan() {
+	idx.lock.RLock()
+	roots := make(map[string]*FileHandler)
+	for k, v := range idx.roots {
+		roots[k] = v
+	}
+	old := idx.dirs
+	idx.lock.RUnlock()
+
+	dirs := make(map[string]*indexedDir)
+	for _, f := range roots {
+		idx.scanDir(f, filepath.Clean(f.OSPath), "", old, dirs)
+	}
+
+	idx.lock.Lock()
+	idx.dirs = dirs
+	text := idx.text
+	idx.lock.Unlock()
+	if text != nil {
+		text.Update(dirs)
+	}
+}
+
+// Searches the contents of indexed text files. Returns an error if full-text
+// indexing is disabled.
+func (idx *Index) FindText(query string) ([]TextMatch, error) {
+	idx.lock.RLock()
+	text := idx.text
+	idx.lock.RUnlock()
+	if text == nil {
+		return nil, errTextIndexDisabled
+	}
+	return text.Find(query), nil
+}
+
+// Indexes the directory at osPath (relPath within the root f) and everything
+// below it into dirs, reusing what's in old where unchanged. Only what f's
+// listings show is indexed.
+func (idx *Index) scanDir(f *FileHandler, osPath, relPath string, old, dirs map[string]*indexedDir) {
+	stat, err := os.Stat(osPath)
+	if err != nil {
+		return
+	}
+	d, has := old[osPath]
+	if has && d.modTime.Equal(stat.ModTime()) {
+		d = restat(osPath, d)
+	} else {
+		files, err := f.listDir(osPath)
+		if err != nil {
+			log.Println("Unable to index", osPath, ":", err)
+			return
+		}
+		d = &indexedDir{modTime: stat.ModTime()}
+		for _, file := range files {
+			e := IndexEntry{Root: f.PathPrefix, RelPath: path.Join(relPath, file.Name()),
+				Name: file.Name(), Size: file.Size(), ModTime: file.ModTime(),
+				IsDir: file.IsDir(), Kind: FileKind(file.Name())}
+			if e.IsDir {
+				e.Kind = KIND_DIR
+			}
+			d.entries = append(d.entries, e)
+		}
+	}
+	dirs[osPath] = d
+	for _, e := range d.entries {
+		if e.IsDir {
+			idx.scanDir(f, filepath.Join(osPath, e.Name), e.RelPath, old, dirs)
+		}
+	}
+}
+
+// Returns a copy of d, the unchanged directory at osPath, with the sizes and
+// modification times of its files brought up to date.
+func restat(osPath string, d *indexedDir) *indexedDir {
+	fresh := &indexedDir{modTime: d.modTime}
+	for _, e := range d.entries {
+		if !e.IsDir {
+			stat, err := os.Stat(filepath.Join(osPath, e.Name))
+			if err != nil {
+				continue
+			}
+			e.Size, e.ModTime = stat.Size(), stat.ModTime()
+		}
+		fresh.entries = append(fresh.entries, e)
+	}
+	return fresh
+}
+
+// A parsed search: words that must all appear in the path, plus filters.
+type SearchQuery struct {
+	Terms   []string
+	Kind    string    // Only entries of this KIND_, if set
+	MinSize int64     // Only files at least this large, if > 0
+	MaxSize int64     // Only files at most this large, if > 0
+	After   time.Time // Only entries modified after this, if set
+	Before  time.Time // Only entries modified before this, if set
+}
+
+// Parses a size like "100", "700k", "1.5G" into bytes.
+func parseSize(s string) (int64, error) {
+	s = strings.TrimSuffix(strings.ToUpper(s), "B")
+	multiplier := 1.0
+	if len(s) > 0 {
+		switch s[len(s)-1] {
+		case 'K':
+			multiplier = 1 << 10
+		case 'M':
+			multiplier = 1 << 20
+		case 'G':
+			multiplier = 1 << 30
+		case 'T':
+			multiplier = 1 << 40
+		}
+		if multiplier > 1 {
+			s = s[:len(s)-1]
+		}
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	return int64(n * multiplier), err
+}
+
+// Parses a search string. Words are search terms, except for filters:
+// "type:video" (or audio, image, doc, archive, dir), "size:>100M",
+// "size:<1G", "after:2012-01-31" and "before:2012-01-31".
+func ParseSearch(s string) (SearchQuery, error) {
+	q := SearchQuery{}
+	for _, word := range strings.Fields(s) {
+		key, value := "", word
+		if i := strings.Index(word, ":"); i > 0 {
+			key, value = strings.ToLower(word[:i]), word[i+1:]
+		}
+		var err error
+		switch key {
+		case "type":
+			q.Kind = strings.ToLower(value)
+			if _, has := kindIcons[q.Kind]; !has {
+				return q, errors.New("Unknown type: " + value)
+			}
+		case "size":
+			if strings.HasPrefix(value, ">") {
+				q.MinSize, err = parseSize(value[1:])
+			} else if strings.HasPrefix(value, "<") {
+				q.MaxSize, err = parseSize(value[1:])
+			} else {
+				err = errors.New("Size filters must start with > or <: " + value)
+			}
+		case "after":
+			q.After, err = time.ParseInLocation("2006-01-02", value, time.Local)
+		case "before":
+			q.Before, err = time.ParseInLocation("2006-01-02", value, time.Local)
+		default:
+			q.Terms = append(q.Terms, strings.ToLower(word))
+		}
+		if err != nil {
+			return q, err
+		}
+	}
+	return q, nil
+}
+
+// Scores how well an entry's name and path match all of the terms, or returns
+// 0 if any term doesn't match at all. Matches in the name count more than in
+// the rest of the path, and whole-name and prefix matches more still.
+func score(e IndexEntry, terms []string) int {
+	name := strings.ToLower(e.Name)
+	base := strings.TrimSuffix(name, path.Ext(name))
+	p := strings.ToLower(e.RelPath)
+	total := 0
+	for _, term := range terms {
+		switch {
+		case base == term || name == term:
+			total += 100
+		case strings.HasPrefix(name, term):
+			total += 50
+		case strings.Contains(name, term):
+			total += 20
+		case strings.Contains(p, term):
+			total += 5
+		default:
+			return 0
+		}
+	}
+	return total
+}
+
+// Returns the indexed entries matching q, best matches first.
+func (idx *Index) Search(q SearchQuery) []IndexEntry {
+	type scored struct {
+		e     IndexEntry
+		score int
+	}
+	matches := []scored{}
+	idx.lock.RLock()
+	for _, d := range idx.dirs {
+		for _, e := range d.entries {
+			if len(q.Kind) > 0 && e.Kind != q.Kind ||
+				q.MinSize > 0 && (e.IsDir || e.Size < q.MinSize) ||
+				q.MaxSize > 0 && (e.IsDir || e.Size > q.MaxSize) ||
+				!q.After.IsZero() && !e.ModTime.After(q.After) ||
+				!q.Before.IsZero() && !e.ModTime.Before(q.Before) {
+				continue
+			}
+			s := 1
+			if len(q.Terms) > 0 {
+				s = score(e, q.Terms)
+			}
+			if s > 0 {
+				matches = append(matches, scored{e, s})
+			}
+		}
+	}
+	idx.lock.RUnlock()
+
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].score != matches[j].score {
+			return matches[i].score > matches[j].score
+		}
+		return matches[i].e.Url() < matches[j].e.Url()
+	})
+	results := []IndexEntry{}
+	for i := 0; i < len(matches) && i < MAX_SEARCH_RESULTS; i++ {
+		results = append(results, matches[i].e)
+	}
+	return results
+}
@@ -0,0 +1,54 @@
+package staticcontent
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Files edited in place leave their directory's modification time alone, but
+// must still be picked up by the next scan.
+func TestScanRestatsEditedFiles(t *testing.T) {
+	root := t.TempDir()
+	p := filepath.Join(root, "notes.txt")
+	if err := ioutil.WriteFile(p, []byte("short"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	idx := NewIndex()
+	idx.AddRoot(&FileHandler{PathPrefix: "/r/", OSPath: root})
+	idx.Scan()
+
+	stat, err := os.Stat(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(p, []byte("a good deal longer"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(root, stat.ModTime(), stat.ModTime())
+	idx.Scan()
+
+	results := idx.Search(SearchQuery{Terms: []string{"notes"}})
+	if len(results) != 1 || results[0].Size != int64(len("a good deal longer")) {
+		t.Errorf("Search after an in-place edit = %+v; want notes.txt with its new size", results)
+	}
+}
+
+func TestScanRereadsChangedDirectories(t *testing.T) {
+	root := t.TempDir()
+	idx := NewIndex()
+	idx.AddRoot(&FileHandler{PathPrefix: "/r/", OSPath: root})
+	idx.Scan()
+	if err := os.Mkdir(filepath.Join(root, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "sub", "new.txt"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	idx.Scan()
+	results := idx.Search(SearchQuery{Terms: []string{"new"}})
+	if len(results) != 1 || results[0].RelPath != "sub/new.txt" {
+		t.Errorf("Search after adding a file = %+v; want sub/new.txt", results)
+	}
+}
@@ -0,0 +1,156 @@
+package staticcontent
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var MODE_JSON = "json"
+
+// A file or directory, as described by the JSON API.
+type JSONEntry struct {
+	Name     string    `json:"name"`
+	Path     string    `json:"path"` // URL path of the entry
+	Size     int64     `json:"size"`
+	ModTime  time.Time `json:"mtime"`
+	MimeType string    `json:"mimeType,omitempty"`
+	IsDir    bool      `json:"isDir"`
+	Playable bool      `json:"playable"` // Whether it opens in the player
+	// URLs for the ways the entry can be fetched: "raw", for directories "zip"
+	// and "tar", and for playable files "player", "transcode" and
+	// "thumbnail".
+	Links map[string]string `json:"links"`
+}
+
+// A directory listing, as returned by the JSON API.
+type JSONListing struct {
+	Path    string      `json:"path"`
+	Entries []JSONEntry `json:"entries"`
+}
+
+// Whether the client asked for JSON, by sc_mode=json or its Accept header.
+func wantsJSON(r *http.Request) bool {
+	return r.FormValue(PARAM_MODE) == MODE_JSON ||
+		strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+// Describes a file whose URL path is urlPath.
+func jsonEntry(urlPath string, file os.FileInfo) JSONEntry {
+	e := JSONEntry{
+		Name:    file.Name(),
+		Path:    urlPath,
+		Size:    file.Size(),
+		ModTime: file.ModTime(),
+		IsDir:   file.IsDir(),
+		Links:   map[string]string{},
+	}
+	if e.IsDir {
+		e.Links["raw"] = urlPath + "?" + PARAM_MODE + "=" + MODE_RAW
+		e.Links["zip"] = urlPath + "?" + PARAM_MODE + "=" + MODE_ZIP
+		e.Links["tar"] = urlPath + "?" + PARAM_MODE + "=" + MODE_TAR
+		return e
+	}
+	e.MimeType = mimeType(e.Name)
+	e.Links["raw"] = urlPath + "?" + PARAM_MODE + "=" + MODE_RAW
+	if isPlayable(e.Name) {
+		e.Playable = true
+		e.Links["player"] = urlPath
+		e.Links["transcode"] = urlPath + "?" + PARAM_MODE + "=" + MODE_TRANSCODE
+	}
+	if isPlayable(e.Name) || IsImage(e.Name) {
+		e.Links["thumbnail"] = urlPath + "?" + PARAM_MODE + "=" + MODE_THUMBNAIL
+	}
+	return e
+}
+
+// Handler for the JSON API: describes the requested file, or lists the
+// requested directory, with the same entries the HTML listing shows.
+func (f *FileHandler) ServeJSON(w http.ResponseWriter, r *http.Request) {
+	p, err := f.localPath(r)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	stat, err := os.Stat(p)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	urlPath := f.PathPrefix + escapePath(r.URL.Path)
+	var result interface{}
+	if stat.IsDir() {
+		files, err := f.listDir(p)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		if !strings.HasSuffix(urlPath, "/") {
+			urlPath += "/"
+		}
+		listing := JSONListing{Path: urlPath, Entries: []JSONEntry{}}
+		for _, file := range files {
+			entryPath := urlPath + url.PathEscape(file.Name())
+			if file.IsDir() {
+				entryPath += "/"
+			}
+			listing.Entries = append(listing.Entries, jsonEntry(entryPath, file))
+		}
+		result = listing
+	} else {
+		result = jsonEntry(urlPath, stat)
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(result)
+}
+
+// Escapes each element of a slash-separated path for use in a URL.
+func escapePath(p string) string {
+	parts := strings.Split(p, "/")
+	for i := range parts {
+		parts[i] = url.PathEscape(parts[i])
+	}
+	return strings.Join(parts, "/")
+}
+
+// Lists the entries of the directory at p that should be shown to clients,
+// sorted by name: not our own files, ones the root's ignore rules hide, nor
+// symlinks its policy won't follow. The HTML and JSON listings, archives and
+// the index use this. Entries describe symlinks themselves, not their
+// targets, but ignore rules for directories apply to symlinks to them too.
+func (f *FileHandler) listDir(p string) ([]os.FileInfo, error) {
+	files, err := ioutil.ReadDir(p)
+	if err != nil {
+		return nil, err
+	}
+	shown := files[:0]
+	for _, file := range files {
+		if isInternalName(file.Name()) {
+			continue
+		}
+		full := filepath.Join(filepath.Clean(p), file.Name())
+		isDir := file.IsDir()
+		if file.Mode()&os.ModeSymlink != 0 {
+			if f.checkSymlinks(full) != nil {
+				continue
+			}
+			if target, err := os.Stat(full); err == nil {
+				isDir = target.IsDir()
+			}
+		}
+		if f.ignoredPath(full, isDir) {
+			continue
+		}
+		shown = append(shown, file)
+	}
+	return shown, nil
+}
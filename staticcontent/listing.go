@@ -0,0 +1,306 @@
+package staticcontent
+
+import (
+	"fmt"
+	"github.com/EricBurnett/WebCmd/resources"
+	"html/template"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+var (
+	// How to render a directory: VIEW_LIST (the default) or VIEW_GRID for a
+	// grid of thumbnails.
+	PARAM_VIEW = "sc_view"
+	VIEW_LIST  = "list"
+	VIEW_GRID  = "grid"
+
+	// How to sort a directory listing: SORT_NAME (the default; numbers in
+	// names sort by value), SORT_SIZE or SORT_DATE, in ORDER_ASC or ORDER_DESC
+	// order. Folders always come first.
+	PARAM_SORT  = "sc_sort"
+	SORT_NAME   = "name"
+	SORT_SIZE   = "size"
+	SORT_DATE   = "date"
+	PARAM_ORDER = "sc_order"
+	ORDER_ASC   = "asc"
+	ORDER_DESC  = "desc"
+)
+
+// Icons shown for each kind of file in listings.
+var kindIcons = map[string]template.HTML{
+	KIND_DIR:     "&#128193;",
+	KIND_VIDEO:   "&#127916;",
+	KIND_AUDIO:   "&#127925;",
+	KIND_IMAGE:   "&#128247;",
+	KIND_DOC:     "&#128196;",
+	KIND_ARCHIVE: "&#128230;",
+	KIND_OTHER:   "&#128196;",
+}
+
+type listingEntry struct {
+	Name    string
+	Url     string
+	IsDir   bool
+	Kind    string
+	Icon    template.HTML
+	Size    string // Human-readable size; empty for folders
+	ModTime string
+	Thumb   string // Thumbnail URL, if the file has one
+	Browse  string // URL to browse the contents of an archive, if it has one
+	Badge   string // The viewer's progress through a video, if any
+	// Whether it can be added to the audio player's queue
+	Queueable bool
+}
+
+type breadcrumb struct {
+	Name string
+	Url  string
+}
+
+// A link to re-sort the listing by one column.
+type sortLink struct {
+	Url    string
+	Active bool
+	Desc   bool
+}
+
+type listingData struct {
+	Path        string
+	Breadcrumbs []breadcrumb
+	Entries     []listingEntry
+	Grid        bool
+	ListUrl     string
+	GridUrl     string
+	RawUrl      string
+	ZipUrl      string
+	TarUrl      string
+	M3uUrl      string
+	XspfUrl     string
+	SortName    sortLink
+	SortSize    sortLink
+	SortDate    sortLink
+	Writable    bool // Whether files can be uploaded and managed here
+	Shareable   bool // Whether share links can be made here
+	Virtual     bool // Whether this is a directory inside an archive
+	TrashUrl    string
+	SharesUrl   string
+	PlayUrl     string // Plays the folder's videos and audio in order, if it has any
+}
+
+var LISTING_TEMPLATE_FILE = "templates/listing.html.template"
+
+// Formats a byte count for humans, e.g. "1.5 MB".
+func HumanSize(n int64) string {
+	if n < 1024 {
+		return fmt.Sprintf("%v B", n)
+	}
+	size := float64(n)
+	for _, unit := range []string{"KB", "MB", "GB", "TB"} {
+		size /= 1024
+		if size < 1024 {
+			return fmt.Sprintf("%.1f %v", size, unit)
+		}
+	}
+	return fmt.Sprintf("%.1f PB", size)
+}
+
+// Sorts directory entries as requested, folders first. Ties are broken by
+// name.
+func sortEntries(files []os.FileInfo, by string, desc bool) {
+	sort.SliceStable(files, func(i, j int) bool {
+		a, b := files[i], files[j]
+		if a.IsDir() != b.IsDir() {
+			return a.IsDir()
+		}
+		if desc {
+			a, b = b, a
+		}
+		switch by {
+		case SORT_SIZE:
+			if a.Size() != b.Size() {
+				return a.Size() < b.Size()
+			}
+		case SORT_DATE:
+			if !a.ModTime().Equal(b.ModTime()) {
+				return a.ModTime().Before(b.ModTime())
+			}
+		}
+		return naturalLess(a.Name(), b.Name())
+	})
+}
+
+// Compares names case-insensitively, with runs of digits compared as
+// numbers, so "Episode 2" sorts before "Episode 10".
+func naturalLess(a, b string) bool {
+	a, b = strings.ToLower(a), strings.ToLower(b)
+	for len(a) > 0 && len(b) > 0 {
+		da, db := digitPrefix(a), digitPrefix(b)
+		if len(da) > 0 && len(db) > 0 {
+			na, nb := strings.TrimLeft(da, "0"), strings.TrimLeft(db, "0")
+			if len(na) != len(nb) {
+				return len(na) < len(nb)
+			}
+			if na != nb {
+				return na < nb
+			}
+			a, b = a[len(da):], b[len(db):]
+			continue
+		}
+		if a[0] != b[0] {
+			return a[0] < b[0]
+		}
+		a, b = a[1:], b[1:]
+	}
+	return len(a) < len(b)
+}
+
+// Returns the leading digits of s.
+func digitPrefix(s string) string {
+	i := 0
+	for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+		i++
+	}
+	return s[:i]
+}
+
+// Serves a directory (via the request URL) as a templated listing, with
+// breadcrumbs, sorting and a filter box, as a list or a grid of thumbnails.
+// The request path must end in a slash, so relative links resolve.
+func (f *FileHandler) ServeListing(w http.ResponseWriter, r *http.Request) {
+	dirPath, err := f.localPath(r)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	files, err := f.listDir(dirPath)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	f.renderListing(w, r, files, false)
+}
+
+// Renders files as the listing of the directory requested by r. Virtual
+// directories (inside archives) can't be changed or downloaded whole, and
+// have no thumbnails.
+func (f *FileHandler) renderListing(w http.ResponseWriter, r *http.Request, files []os.FileInfo, virtual bool) {
+	template_content, err := resources.Load(LISTING_TEMPLATE_FILE)
+	if err != nil {
+		f.FallbackHandler.ServeHTTP(w, r)
+		return
+	}
+	var listingTemplate = template.New("Listing template")
+	listingTemplate, err = listingTemplate.Parse(string(template_content))
+	if err != nil {
+		f.FallbackHandler.ServeHTTP(w, r)
+		return
+	}
+
+	view := r.FormValue(PARAM_VIEW)
+	by := r.FormValue(PARAM_SORT)
+	if by != SORT_SIZE && by != SORT_DATE {
+		by = SORT_NAME
+	}
+	desc := r.FormValue(PARAM_ORDER) == ORDER_DESC
+	sortEntries(files, by, desc)
+
+	// Builds a query string for this listing with some parameters replaced.
+	query := func(overrides ...string) string {
+		params := url.Values{}
+		for _, p := range []string{PARAM_VIEW, PARAM_SORT, PARAM_ORDER} {
+			if len(r.FormValue(p)) > 0 {
+				params.Set(p, r.FormValue(p))
+			}
+		}
+		for i := 0; i+1 < len(overrides); i += 2 {
+			params.Set(overrides[i], overrides[i+1])
+		}
+		if len(params) == 0 {
+			return ""
+		}
+		return "?" + params.Encode()
+	}
+	link := func(column string) sortLink {
+		l := sortLink{Active: by == column, Desc: by == column && desc}
+		order := ORDER_ASC
+		if l.Active && !desc {
+			order = ORDER_DESC
+		}
+		l.Url = query(PARAM_SORT, column, PARAM_ORDER, order)
+		return l
+	}
+
+	data := &listingData{
+		Path:     f.PathPrefix + r.URL.Path,
+		Grid:     view == VIEW_GRID,
+		ListUrl:  query(PARAM_VIEW, VIEW_LIST),
+		GridUrl:  query(PARAM_VIEW, VIEW_GRID),
+		RawUrl:   "?" + PARAM_MODE + "=" + MODE_RAW,
+		ZipUrl:   "?" + PARAM_MODE + "=" + MODE_ZIP,
+		TarUrl:   "?" + PARAM_MODE + "=" + MODE_TAR,
+		M3uUrl:   "?" + PARAM_MODE + "=" + MODE_M3U,
+		XspfUrl:  "?" + PARAM_MODE + "=" + MODE_XSPF,
+		SortName: link(SORT_NAME),
+		SortSize: link(SORT_SIZE),
+		SortDate: link(SORT_DATE),
+		// Visitors with a share link can only look.
+		Writable:  f.Options.Writable && !virtual && authorized(r),
+		Shareable: !virtual && authorized(r),
+		Virtual:   virtual,
+		TrashUrl:  f.PathPrefix + "?" + PARAM_MODE + "=" + MODE_TRASH,
+		SharesUrl: SHARES_PATH,
+	}
+
+	// Breadcrumbs run from the root's name down to this directory.
+	crumbUrl := f.PathPrefix
+	data.Breadcrumbs = append(data.Breadcrumbs,
+		breadcrumb{path.Base(f.PathPrefix), crumbUrl + query()})
+	for _, part := range strings.Split(strings.Trim(r.URL.Path, "/"), "/") {
+		if len(part) == 0 {
+			continue
+		}
+		crumbUrl += url.PathEscape(part) + "/"
+		data.Breadcrumbs = append(data.Breadcrumbs, breadcrumb{part, crumbUrl + query()})
+	}
+
+	// Audio files get thumbnails only in folders with a cover image, to
+	// avoid probing each for embedded art.
+	hasCover := false
+	if dir, err := f.localPath(r); err == nil && !virtual {
+		hasCover = len(f.folderCover(dir)) > 0
+	}
+	for _, file := range files {
+		name := file.Name()
+		// "./" keeps names like "Show: Ep1.mkv" from being read as URL schemes.
+		e := listingEntry{Name: name, Url: "./" + url.PathEscape(name),
+			IsDir: file.IsDir(), Kind: FileKind(name),
+			ModTime: file.ModTime().Format("2006-01-02 15:04")}
+		if e.IsDir {
+			e.Kind = KIND_DIR
+			e.Url += "/" + query()
+		} else {
+			e.Size = HumanSize(file.Size())
+			if !virtual && (IsVideo(name) || IsImage(name) || (IsAudio(name) && hasCover)) {
+				e.Thumb = e.Url + "?" + PARAM_MODE + "=" + MODE_THUMBNAIL
+			}
+			if !virtual && len(archiveFormat(name)) > 0 {
+				e.Browse = e.Url + ARCHIVE_SEPARATOR
+			}
+			if !virtual && IsVideo(name) {
+				e.Badge = viewerProgress(r, data.Path+name).Badge()
+			}
+			if !virtual && isPlayable(name) {
+				data.PlayUrl = "?" + PARAM_MODE + "=" + MODE_PLAY
+			}
+			e.Queueable = !virtual && IsAudio(name)
+		}
+		e.Icon = kindIcons[e.Kind]
+		data.Entries = append(data.Entries, e)
+	}
+	listingTemplate.Execute(w, data)
+}
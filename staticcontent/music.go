@@ -0,0 +1,259 @@
+package staticcontent
+
+import (
+	"flag"
+	"fmt"
+	"github.com/EricBurnett/WebCmd/platform"
+	"github.com/EricBurnett/WebCmd/resources"
+	"html/template"
+	"log"
+	"net/http"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+var custom_audio_player = flag.Bool("custom_audio_player", true,
+	"Play audio files in a custom audio player.")
+var transcode_lossless = flag.String("transcode_lossless", LOSSLESS_MOBILE,
+	"When to transcode lossless audio (FLAC, ALAC, WAV) to save bandwidth: "+
+		"\"always\", \"mobile\" (for phones and tablets) or \"never\". Audio "+
+		"the browser can't play is transcoded regardless.")
+
+var (
+	LOSSLESS_ALWAYS = "always"
+	LOSSLESS_MOBILE = "mobile"
+	LOSSLESS_NEVER  = "never"
+
+	// "low" to have lossless audio transcoded, or "original" to play it
+	// as-is. Picked in the audio player, which remembers it in
+	// QUALITY_COOKIE.
+	PARAM_QUALITY    = "sc_quality"
+	QUALITY_LOW      = "low"
+	QUALITY_ORIGINAL = "original"
+	QUALITY_COOKIE   = "sc_quality"
+)
+
+// Lossless audio codecs, as named by the prober. PCM ("pcm_s16le", ...) is
+// too.
+var losslessCodecs = map[string]bool{
+	"flac": true, "alac": true, "wavpack": true, "ape": true, "tta": true,
+}
+
+// The usual codec of each audio extension, for files that can't be probed.
+var audioExtensionCodecs = map[string]string{
+	"mp3": "mp3", "m4a": "aac", "aac": "aac", "ogg": "vorbis", "oga": "vorbis",
+	"opus": "opus", "flac": "flac", "wav": "pcm_s16le", "wma": "wmav2",
+}
+
+// Transcode profiles for audio files. Opus is smaller for the same quality;
+// MP3 is for clients that can't play it.
+var audioProfiles = map[string]*Profile{
+	"opus": {"opus", FORMAT_WEBM, "audio/webm", "opus", strings.Split(
+		"-map 0:a:0 -vn -acodec libopus -b:a 96k -ac 2", " ")},
+	"mp3": {"mp3", "", "audio/mpeg", "", strings.Split(
+		"-map 0:a:0 -vn -acodec libmp3lame -b:a 160k -ac 2 -f mp3 -", " ")},
+}
+
+// Names of the images in a folder used as the cover of its audio files,
+// lowercase, in order of preference.
+var folderCoverNames = []string{
+	"folder.jpg", "folder.png", "cover.jpg", "cover.png", "front.jpg",
+	"front.png", "album.jpg", "album.png",
+}
+
+func isLossless(codec string) bool {
+	return losslessCodecs[codec] || strings.HasPrefix(codec, "pcm_")
+}
+
+// Whether a client with caps can play audio in codec.
+func audioPlayable(codec string, caps ClientCaps) bool {
+	switch {
+	case strings.HasPrefix(codec, "pcm_"):
+		// WAV plays everywhere.
+		return true
+	case codec == "mp3", codec == "aac", codec == "opus", codec == "vorbis",
+		codec == "flac":
+		return caps.Can(codec)
+	}
+	return false
+}
+
+// Whether r's client wants lossless audio transcoded to save bandwidth: as
+// picked in the player, else as --transcode_lossless says for its device.
+func wantsLowBandwidth(r *http.Request) bool {
+	quality := r.FormValue(PARAM_QUALITY)
+	if cookie, err := r.Cookie(QUALITY_COOKIE); err == nil && len(quality) == 0 {
+		quality = cookie.Value
+	}
+	switch quality {
+	case QUALITY_LOW:
+		return true
+	case QUALITY_ORIGINAL:
+		return false
+	}
+	switch *transcode_lossless {
+	case LOSSLESS_ALWAYS:
+		return true
+	case LOSSLESS_MOBILE:
+		return DeviceClass(r) == MOBILE
+	}
+	return false
+}
+
+// Returns the profile to transcode audio with for r: the one requested via
+// sc_profile if it's an audio profile, otherwise Opus if the client can play
+// it, otherwise MP3.
+func ChooseAudioProfile(r *http.Request) *Profile {
+	if p, has := audioProfiles[r.FormValue(PARAM_PROFILE)]; has {
+		return p
+	}
+	if ClientCapabilities(r).Can("webm", "opus") {
+		return audioProfiles["opus"]
+	}
+	return audioProfiles["mp3"]
+}
+
+// Decides how the audio file requested by r (with extension ext) should be
+// served: as-is if the client can play it, unless it's lossless and the
+// client wants to save bandwidth; otherwise transcoded.
+func (f *FileHandler) DecideAudio(ext string, r *http.Request) Decision {
+	if !*transcode {
+		return Decision{Method: DirectPlay, Container: ext}
+	}
+	codec := audioExtensionCodecs[ext]
+	if audioPath, err := f.localPath(r); err == nil {
+		if info, err := Probe(audioPath); err == nil {
+			if s := info.First("audio"); s != nil {
+				codec = s.CodecName
+			}
+		}
+	}
+	profile := ChooseAudioProfile(r)
+	d := Decision{Method: Transcode, Profile: profile,
+		Container: profile.ContentType[strings.Index(profile.ContentType, "/")+1:]}
+	if _, requested := audioProfiles[r.FormValue(PARAM_PROFILE)]; !requested &&
+		audioPlayable(codec, ClientCapabilities(r)) &&
+		!(isLossless(codec) && wantsLowBandwidth(r)) {
+		d = Decision{Method: DirectPlay, Container: ext}
+	}
+	log.Println("Serving", r.URL.Path, "as", d.Mode(), d.Container)
+	return d
+}
+
+// Returns the path of the cover image in the directory at dir, or "" if it
+// has none. Only images the root's listings show count.
+func (f *FileHandler) folderCover(dir string) string {
+	files, err := f.listDir(dir)
+	if err != nil {
+		return ""
+	}
+	found := make(map[string]string)
+	for _, file := range files {
+		found[strings.ToLower(file.Name())] = file.Name()
+	}
+	for _, name := range folderCoverNames {
+		if actual, has := found[name]; has {
+			return filepath.Join(dir, actual)
+		}
+	}
+	return ""
+}
+
+// Whether the audio file at p has cover art embedded in it. The prober lists
+// embedded pictures as video streams.
+func hasEmbeddedCover(p string) bool {
+	info, err := Probe(p)
+	return err == nil && info.First("video") != nil
+}
+
+// Extracts the cover art embedded in the audio file at p with the
+// transcoder.
+func audioCover(p string, out string, width int) error {
+	cmd := exec.Command(*transcoder, *transcode_input_flag, p, "-an",
+		"-frames:v", "1", "-vf", fmt.Sprintf("scale=%v:-2", width), "-q:v", "4",
+		"-y", out)
+	platform.Hide(cmd)
+	log.Println("Calling", cmd.Path, cmd.Args)
+	return cmd.Run()
+}
+
+// A tag shown in the audio player.
+type tagLine struct {
+	Label string
+	Value string
+}
+
+type audioData struct {
+	Title       string // From the tags, else the file name
+	Url         string
+	DownloadUrl string
+	Type        string // MIME type of the stream at Url
+	Cover       string
+	Tags        []tagLine
+	NeedCaps    bool   // Whether the page should report client capabilities
+	Transcoded  bool   // Whether the stream at Url is transcoded
+	Lossless    bool   // Whether the file is lossless, so quality matters
+	Quality     string // The quality picked in the player, if any
+	Autoplay    bool   // Whether to start playing, and go on to the next file
+	folderQueue
+}
+
+var AUDIO_TEMPLATE_FILE = "templates/audio.html.template"
+
+// Serves an audio player page for a file (via the request URL), with its
+// cover art, tags and the other files in its folder. The audio URL will point
+// to the raw file or transcode handler as decided by d.
+func (f *FileHandler) ServeAudioPlayer(d Decision, w http.ResponseWriter, r *http.Request) {
+	template_content, err := resources.Load(AUDIO_TEMPLATE_FILE)
+	if err != nil {
+		f.serveFallback(w, r)
+		return
+	}
+	audioTemplate, err := template.New("Audio template").Parse(string(template_content))
+	if err != nil {
+		f.serveFallback(w, r)
+		return
+	}
+
+	name := filepath.Base(r.URL.Path)
+	a := &audioData{Title: strings.TrimSuffix(name, filepath.Ext(name)),
+		Url: "?" + PARAM_MODE + "=" + d.Mode(), DownloadUrl: "?" + PARAM_MODE + "=" + MODE_RAW,
+		Type:       mimeType(name),
+		Cover:      "?" + PARAM_MODE + "=" + MODE_THUMBNAIL + "&" + PARAM_WIDTH + "=600",
+		NeedCaps:   *transcode && !ClientCapabilities(r).Reported(),
+		Transcoded: d.Method == Transcode,
+		Quality:    r.FormValue(PARAM_QUALITY),
+		Autoplay:   len(r.FormValue(PARAM_AUTOPLAY)) > 0}
+	if a.Transcoded {
+		a.Type = d.SourceType()
+	}
+	if cookie, err := r.Cookie(QUALITY_COOKIE); err == nil && len(a.Quality) == 0 {
+		a.Quality = cookie.Value
+	}
+	if audioPath, err := f.localPath(r); err == nil {
+		if info, err := Probe(audioPath); err == nil {
+			if title := info.Tag("title"); len(title) > 0 {
+				a.Title = title
+			}
+			if s := info.First("audio"); s != nil {
+				a.Lossless = isLossless(s.CodecName)
+			}
+			for _, t := range []struct{ label, value string }{
+				{"Artist", info.Tag("artist", "album_artist")},
+				{"Album", info.Tag("album")},
+				{"Track", info.Tag("track")},
+				{"Year", info.Tag("date", "year")},
+				{"Genre", info.Tag("genre")},
+			} {
+				if len(t.value) > 0 {
+					a.Tags = append(a.Tags, tagLine{t.label, t.value})
+				}
+			}
+		} else {
+			a.Lossless = isLossless(audioExtensionCodecs[extension(name)])
+		}
+		a.folderQueue = f.queueFor(r, audioPath)
+	}
+	audioTemplate.Execute(w, a)
+}
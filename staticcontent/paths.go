@@ -2,18 +2,75 @@ package staticcontent
 
 import (
 	"encoding/csv"
+	"errors"
 	"flag"
 	"io"
 	"log"
 	"os"
+	"strconv"
+	"strings"
 )
 
 var static_content_config = flag.String("static_content_config", "",
 	"Path to the static content config csv file, for auto-configuring custom"+
 		"static paths. See staticcontent/example_paths.csv for examples.")
 
+// Per-root settings, given as extra columns after the name and path in the
+// static content config.
+type RootOptions struct {
+	// Whether files may be uploaded into the root.
+	Writable bool
+	// How symlinks are followed (a SYMLINKS_ policy), if not per --symlinks.
+	Symlinks string
+	// Whether files and directories whose names start with "." are hidden.
+	HideDotfiles bool
+	// Gitignore-style patterns of paths to hide; see matchIgnore.
+	Ignore []string
+	// Most bytes per second the root's files may be sent at; 0 for no limit.
+	Bandwidth int64
+}
+
+// Parses the option columns of a static content config line. Each is either
+// a bare flag ("writable", "hide_dotfiles") or a key=value setting
+// ("symlinks=deny", "ignore=*.part", "bandwidth=1048576"; ignore may be
+// repeated).
+func ParseRootOptions(columns []string) (RootOptions, error) {
+	opts := RootOptions{}
+	for _, column := range columns {
+		key := strings.TrimSpace(column)
+		if len(key) == 0 {
+			continue
+		}
+		value := ""
+		if i := strings.Index(key, "="); i >= 0 {
+			key, value = key[:i], key[i+1:]
+		}
+		switch {
+		case key == "writable" && len(value) == 0:
+			opts.Writable = true
+		case key == "hide_dotfiles" && len(value) == 0:
+			opts.HideDotfiles = true
+		case key == "symlinks" && symlinkPolicies[value]:
+			opts.Symlinks = value
+		case key == "ignore" && len(value) > 0:
+			opts.Ignore = append(opts.Ignore, value)
+		case key == "bandwidth":
+			bandwidth, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || bandwidth < 0 {
+				return opts, errors.New("Invalid bandwidth: " + column)
+			}
+			opts.Bandwidth = bandwidth
+		default:
+			return opts, errors.New("Unknown root option: " + column)
+		}
+	}
+	return opts, nil
+}
+
 // Adds paths to the static content server based on the shared configuration
-// file. Any paths that cannot be interpreted or found will be ignored.
+// file. Each line is a name, a path, and optionally root options (see
+// ParseRootOptions). Any paths that cannot be interpreted or found will be
+// ignored.
 func AddCsvPaths(s *Server) error {
 	if len(*static_content_config) == 0 {
 		log.Println("No static content config found; not mapping any " +
@@ -26,6 +83,7 @@ func AddCsvPaths(s *Server) error {
 		return err
 	}
 	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = -1
 	for {
 		record, err := reader.Read()
 		if err == io.EOF {
@@ -33,11 +91,16 @@ func AddCsvPaths(s *Server) error {
 		} else if err != nil {
 			return err
 		}
-		if len(record) != 2 {
+		if len(record) < 2 {
 			log.Println("Malformed mapping in static content csv file:", record)
 			continue
 		}
-		s.Install(record[0], record[1])
+		opts, err := ParseRootOptions(record[2:])
+		if err != nil {
+			log.Println("Malformed options in static content csv file:", record, err)
+			continue
+		}
+		s.InstallWithOptions(record[0], record[1], opts)
 	}
 	return nil
 }
@@ -0,0 +1,168 @@
+package staticcontent
+
+import (
+	"encoding/xml"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	// Lists a directory's audio and video files as a playlist, for players
+	// like VLC and mpv. Links are absolute, and carry a share token when
+	// --static_auth is set, since players can't log in.
+	MODE_M3U  = "m3u"
+	MODE_XSPF = "xspf"
+
+	// Includes the files of subdirectories in playlists too.
+	PARAM_RECURSIVE = "sc_recursive"
+
+	// Set to MODE_TRANSCODE for playlists to link videos' transcodes rather
+	// than the files themselves.
+	PARAM_LINKS = "sc_links"
+)
+
+// A file in a playlist.
+type playlistItem struct {
+	Title string // Path relative to the playlist's directory
+	Url   string
+}
+
+// Lists the audio and video files in the directory at dir, whose path
+// relative to the playlist's directory is rel, in natural order.
+// Subdirectories' files are listed in place if recursive.
+func (f *FileHandler) playlistItems(dir, rel string, recursive bool) []playlistItem {
+	files, err := f.listDir(dir)
+	if err != nil {
+		return nil
+	}
+	sort.Slice(files, func(i, j int) bool { return naturalLess(files[i].Name(), files[j].Name()) })
+	items := []playlistItem{}
+	for _, file := range files {
+		name := path.Join(rel, file.Name())
+		if file.IsDir() {
+			if recursive {
+				items = append(items, f.playlistItems(filepath.Join(dir, file.Name()), name, true)...)
+			}
+			continue
+		}
+		if kind := FileKind(name); kind == KIND_VIDEO || kind == KIND_AUDIO {
+			items = append(items, playlistItem{Title: name})
+		}
+	}
+	return items
+}
+
+// Returns the scheme and host r was sent to, e.g. "http://example.com:8080".
+func baseUrl(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	} else if proto := r.Header.Get("X-Forwarded-Proto"); proto == "https" {
+		scheme = proto
+	}
+	return scheme + "://" + r.Host
+}
+
+// Handler for playlists of directories: MODE_M3U or MODE_XSPF, as requested.
+func (f *FileHandler) ServePlaylist(w http.ResponseWriter, r *http.Request) {
+	dir, err := f.localPath(r)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	if stat, err := os.Stat(dir); err != nil || !stat.IsDir() {
+		http.Error(w, "Only folders have playlists.", http.StatusBadRequest)
+		return
+	}
+	dirUrl := path.Join(f.PathPrefix, "/"+r.URL.Path)
+	params := url.Values{}
+	if AuthEnabled() {
+		// Players can't log in, so playlists carry a share of the folder,
+		// which can be revoked on its own.
+		expires := DEFAULT_SHARE_EXPIRY
+		if e := r.URL.Query().Get(PARAM_EXPIRES); len(e) > 0 {
+			if expires, err = time.ParseDuration(e); err != nil {
+				http.Error(w, "Invalid expiry: "+e, http.StatusBadRequest)
+				return
+			}
+		}
+		// Visitors with a share can't outlast it.
+		if share := visitorShare(r); share != nil && !authorized(r) {
+			if left := time.Until(share.Expires); left < expires {
+				expires = left
+			}
+		}
+		token, err := f.server.PlaylistToken(dirUrl, expires)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		params.Set(PARAM_SHARE, token)
+	}
+
+	base := baseUrl(r)
+	transcodeVideos := r.FormValue(PARAM_LINKS) == MODE_TRANSCODE && *transcode
+	items := f.playlistItems(dir, "", len(r.FormValue(PARAM_RECURSIVE)) > 0)
+	for i := range items {
+		mode := MODE_RAW
+		if transcodeVideos && IsVideo(items[i].Title) {
+			mode = MODE_TRANSCODE
+		}
+		params.Set(PARAM_MODE, mode)
+		items[i].Url = base + escapePath(path.Join(dirUrl, items[i].Title)) + "?" + params.Encode()
+	}
+
+	name := path.Base(dirUrl)
+	mode := r.URL.Query().Get(PARAM_MODE)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("inline",
+		map[string]string{"filename": name + "." + mode}))
+	if mode == MODE_XSPF {
+		writeXSPF(w, name, items)
+	} else {
+		writeM3U(w, items)
+	}
+}
+
+// Writes items as an extended M3U playlist.
+func writeM3U(w http.ResponseWriter, items []playlistItem) {
+	w.Header().Set("Content-Type", "audio/x-mpegurl; charset=utf-8")
+	fmt.Fprintln(w, "#EXTM3U")
+	for _, item := range items {
+		// Line breaks would end the entry early.
+		title := strings.NewReplacer("\r", " ", "\n", " ").Replace(item.Title)
+		fmt.Fprintf(w, "#EXTINF:-1,%s\n%s\n", title, item.Url)
+	}
+}
+
+type xspfTrack struct {
+	Location string `xml:"location"`
+	Title    string `xml:"title"`
+}
+
+type xspfPlaylist struct {
+	XMLName xml.Name    `xml:"http://xspf.org/ns/0/ playlist"`
+	Version string      `xml:"version,attr"`
+	Title   string      `xml:"title"`
+	Tracks  []xspfTrack `xml:"trackList>track"`
+}
+
+// Writes items as an XSPF playlist titled title.
+func writeXSPF(w http.ResponseWriter, title string, items []playlistItem) {
+	w.Header().Set("Content-Type", "application/xspf+xml; charset=utf-8")
+	p := xspfPlaylist{Version: "1", Title: title}
+	for _, item := range items {
+		p.Tracks = append(p.Tracks, xspfTrack{Location: item.Url, Title: item.Title})
+	}
+	fmt.Fprint(w, xml.Header)
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	enc.Encode(p)
+}
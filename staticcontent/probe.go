@@ -0,0 +1,179 @@
+package staticcontent
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"github.com/EricBurnett/WebCmd/platform"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var prober = flag.String("prober", "ffprobe",
+	"The media prober to use for detecting codecs, either as a fully "+
+		"qualified path or as an executable on the path. Must accept ffprobe "+
+		"arguments. If set to '', files are never probed.")
+
+var errNoProber = errors.New("No prober configured.")
+
+// A single stream (video, audio, subtitle...) within a media file.
+type Stream struct {
+	Index     int    // Index of the stream within the file
+	CodecType string // "video", "audio", "subtitle", ...
+	CodecName string // Codec as named by the prober, e.g. "h264" or "aac"
+	Profile   string // Codec profile, if known
+	Language  string // Language tag, if any
+	Title     string // Stream title, if any
+	Channels  int    // Audio channel count
+	Width     int    // Video width
+	Height    int    // Video height
+	Default   bool   // Whether the file marks this stream as a default
+}
+
+// Information about a media file, as reported by the prober.
+type MediaInfo struct {
+	Format   string   // Container format names, e.g. "matroska,webm"
+	Duration float64  // Duration in seconds, or 0 if unknown
+	Streams  []Stream // All streams in the file
+	// Metadata tags (ID3, Vorbis comments...) by lowercase name, e.g.
+	// "title" or "artist".
+	Tags map[string]string
+}
+
+// Returns the first of the named tags that's set, or "".
+func (m *MediaInfo) Tag(names ...string) string {
+	for _, name := range names {
+		if v := strings.TrimSpace(m.Tags[name]); len(v) > 0 {
+			return v
+		}
+	}
+	return ""
+}
+
+// Returns tags with lowercase names.
+func lowerTags(tags map[string]string) map[string]string {
+	lower := make(map[string]string)
+	for k, v := range tags {
+		lower[strings.ToLower(k)] = v
+	}
+	return lower
+}
+
+// Returns the first stream of the given type, or nil if there isn't one.
+func (m *MediaInfo) First(codecType string) *Stream {
+	for i := range m.Streams {
+		if m.Streams[i].CodecType == codecType {
+			return &m.Streams[i]
+		}
+	}
+	return nil
+}
+
+// Returns all streams of the given type, in file order.
+func (m *MediaInfo) All(codecType string) []Stream {
+	streams := []Stream{}
+	for _, s := range m.Streams {
+		if s.CodecType == codecType {
+			streams = append(streams, s)
+		}
+	}
+	return streams
+}
+
+// The subset of ffprobe's JSON output that we care about.
+type probeOutput struct {
+	Streams []struct {
+		Index       int               `json:"index"`
+		CodecType   string            `json:"codec_type"`
+		CodecName   string            `json:"codec_name"`
+		Profile     string            `json:"profile"`
+		Channels    int               `json:"channels"`
+		Width       int               `json:"width"`
+		Height      int               `json:"height"`
+		Tags        map[string]string `json:"tags"`
+		Disposition struct {
+			Default int `json:"default"`
+		} `json:"disposition"`
+	} `json:"streams"`
+	Format struct {
+		FormatName string            `json:"format_name"`
+		Duration   string            `json:"duration"`
+		Tags       map[string]string `json:"tags"`
+	} `json:"format"`
+}
+
+type probeCacheEntry struct {
+	modTime time.Time
+	size    int64
+	info    *MediaInfo
+}
+
+var (
+	probeCacheLock sync.Mutex
+	probeCache     = make(map[string]probeCacheEntry)
+)
+
+// Probes the media file at path for its container and streams. Results are
+// cached until the file changes on disk.
+func Probe(path string) (*MediaInfo, error) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	probeCacheLock.Lock()
+	entry, has := probeCache[path]
+	probeCacheLock.Unlock()
+	if has && entry.modTime.Equal(stat.ModTime()) && entry.size == stat.Size() {
+		return entry.info, nil
+	}
+
+	if len(*prober) == 0 {
+		return nil, errNoProber
+	}
+	cmd := exec.Command(*prober, "-v", "quiet", "-print_format", "json",
+		"-show_format", "-show_streams", path)
+	platform.Hide(cmd)
+	out, err := cmd.Output()
+	if err != nil {
+		log.Println("Unable to probe", path, ":", err)
+		return nil, err
+	}
+	var parsed probeOutput
+	if err = json.Unmarshal(out, &parsed); err != nil {
+		log.Println("Unable to parse probe output for", path, ":", err)
+		return nil, err
+	}
+
+	info := &MediaInfo{Format: parsed.Format.FormatName,
+		Tags: lowerTags(parsed.Format.Tags)}
+	info.Duration, _ = strconv.ParseFloat(parsed.Format.Duration, 64)
+	for _, s := range parsed.Streams {
+		tags := lowerTags(s.Tags)
+		if len(info.Tags) == 0 && s.CodecType == "audio" {
+			// Ogg files keep their Vorbis comments on the stream.
+			info.Tags = tags
+		}
+		info.Streams = append(info.Streams, Stream{
+			Index:     s.Index,
+			CodecType: s.CodecType,
+			CodecName: s.CodecName,
+			Profile:   s.Profile,
+			Language:  tags["language"],
+			Title:     tags["title"],
+			Channels:  s.Channels,
+			Width:     s.Width,
+			Height:    s.Height,
+			Default:   s.Disposition.Default != 0,
+		})
+	}
+
+	probeCacheLock.Lock()
+	probeCache[path] = probeCacheEntry{stat.ModTime(), stat.Size(), info}
+	probeCacheLock.Unlock()
+	return info, nil
+}
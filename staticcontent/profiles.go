@@ -0,0 +1,255 @@
+package staticcontent
+
+import (
+	"encoding/csv"
+	"flag"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var transcode_profiles_config = flag.String("transcode_profiles_config", "",
+	"Path to a csv file of extra named transcode profiles, as "+
+		"\"name\",\"content type or format\",\"transcode settings\" lines, "+
+		"optionally followed by a codecs string. Profiles with built-in names "+
+		"replace the built-in versions.")
+var desktop_profile = flag.String("desktop_profile", DEFAULT_PROFILE,
+	"Transcode profile used for desktop browsers unless one is requested.")
+var mobile_profile = flag.String("mobile_profile", "mobile-low",
+	"Transcode profile used for phones and tablets unless one is requested.")
+var tv_profile = flag.String("tv_profile", "h264-1080p",
+	"Transcode profile used for TVs and streaming sticks unless one is "+
+		"requested.")
+var fallback_profile = flag.String("fallback_profile", "h264-1080p",
+	"Transcode profile used in place of a WebM one for clients that can't "+
+		"play WebM.")
+
+var (
+	PARAM_PROFILE = "sc_profile"
+
+	// The profile built from --transcode_settings and
+	// --transcode_content_type.
+	DEFAULT_PROFILE = "default"
+
+	// Output formats a profile may select instead of spelling out the
+	// container arguments itself.
+	FORMAT_FMP4 = "fmp4" // Fragmented MP4, streamable to a pipe
+	FORMAT_WEBM = "webm"
+)
+
+type outputFormat struct {
+	contentType string
+	args        []string // Transcoder arguments that select the container
+}
+
+var outputFormats = map[string]outputFormat{
+	FORMAT_FMP4: {"video/mp4", []string{"-movflags",
+		"frag_keyframe+empty_moov+default_base_moof", "-f", "mp4", "-"}},
+	FORMAT_WEBM: {"video/webm", []string{"-f", "webm", "-"}},
+}
+
+// A named set of transcoder settings.
+type Profile struct {
+	Name string
+	// One of the FORMAT_ constants, or "" if Settings choose the container.
+	Format string
+	// Full MIME type of the output, e.g. "video/webm".
+	ContentType string
+	// RFC 6381 codecs of the output, e.g. "vp8, vorbis", if known.
+	Codecs string
+	// Transcoder arguments following the input file.
+	Settings []string
+}
+
+// The full transcoder arguments following the input file, including those
+// for the profile's output format.
+func (p *Profile) Args() []string {
+	args := append([]string{}, p.Settings...)
+	if f, has := outputFormats[p.Format]; has {
+		args = append(args, f.args...)
+	}
+	return args
+}
+
+// The MIME type of the output including its codecs, if known, for use as a
+// <source> type.
+func (p *Profile) SourceType() string {
+	if len(p.Codecs) == 0 {
+		return p.ContentType
+	}
+	return p.ContentType + "; codecs=\"" + p.Codecs + "\""
+}
+
+// Whether the output is WebM.
+func (p *Profile) IsWebM() bool {
+	return strings.HasSuffix(p.ContentType, "/webm")
+}
+
+// Profiles available without any configuration. The default profile is added
+// from flags when profiles are first used.
+var builtinProfiles = []Profile{
+	{"webm-720p", FORMAT_WEBM, "video/webm", "vp8, vorbis", strings.Split(
+		"-vcodec libvpx -threads 0 -vf scale=-2:min(720\\,ih) -b:v 2500k "+
+			"-bufsize 50m -acodec libvorbis -ab 96k -ac 2 -quality realtime",
+		" ")},
+	{"h264-1080p", FORMAT_FMP4, "video/mp4", "avc1.640028, mp4a.40.2",
+		strings.Split("-vcodec libx264 -preset veryfast -profile:v high "+
+			"-level 4.0 -pix_fmt yuv420p -vf scale=-2:min(1080\\,ih) "+
+			"-b:v 6000k -maxrate 6000k -bufsize 12000k -acodec aac -b:a 192k "+
+			"-ac 2", " ")},
+	{"mobile-low", FORMAT_FMP4, "video/mp4", "avc1.42E01E, mp4a.40.2",
+		strings.Split("-vcodec libx264 -preset veryfast -profile:v baseline "+
+			"-level 3.0 -pix_fmt yuv420p -vf scale=-2:min(480\\,ih) -b:v 800k "+
+			"-maxrate 800k -bufsize 1600k -acodec aac -b:a 96k -ac 2", " ")},
+	{"audio-only", FORMAT_WEBM, "audio/webm", "opus", strings.Split(
+		"-vn -acodec libopus -b:a 96k -ac 2", " ")},
+}
+
+var (
+	profilesOnce sync.Once
+	profiles     map[string]*Profile
+)
+
+// Returns all transcode profiles by name, loading them on first use.
+func Profiles() map[string]*Profile {
+	profilesOnce.Do(loadProfiles)
+	return profiles
+}
+
+// Returns the names of all transcode profiles, sorted.
+func ProfileNames() []string {
+	names := []string{}
+	for name := range Profiles() {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func loadProfiles() {
+	profiles = make(map[string]*Profile)
+	for i := range builtinProfiles {
+		profiles[builtinProfiles[i].Name] = &builtinProfiles[i]
+	}
+	profiles[DEFAULT_PROFILE] = &Profile{
+		Name:        DEFAULT_PROFILE,
+		ContentType: "video/" + *transcode_content_type,
+		Settings:    strings.Split(*transcode_settings, " "),
+	}
+	if err := addCsvProfiles(); err != nil {
+		log.Println("Error loading transcode profiles from csv:", err)
+	}
+}
+
+// Adds profiles from --transcode_profiles_config. Malformed lines are skipped.
+func addCsvProfiles() error {
+	if len(*transcode_profiles_config) == 0 {
+		return nil
+	}
+	file, err := os.Open(*transcode_profiles_config)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = -1
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		if len(record) != 3 && len(record) != 4 {
+			log.Println("Malformed profile in transcode profiles csv file:", record)
+			continue
+		}
+		log.Println("Installing transcode profile", record[0])
+		p := &Profile{
+			Name:        record[0],
+			ContentType: record[1],
+			Settings:    strings.Split(record[2], " "),
+		}
+		if f, has := outputFormats[record[1]]; has {
+			p.Format = record[1]
+			p.ContentType = f.contentType
+		}
+		if len(record) == 4 {
+			p.Codecs = record[3]
+		}
+		profiles[record[0]] = p
+	}
+	return nil
+}
+
+// Broad classes of client device, for picking default profiles.
+const (
+	DESKTOP = "desktop"
+	MOBILE  = "mobile"
+	TV      = "tv"
+)
+
+// Guesses the class of device making the request from its User-Agent.
+func DeviceClass(r *http.Request) string {
+	ua := r.UserAgent()
+	for _, marker := range []string{"SmartTV", "SMART-TV", "Tizen", "Web0S",
+		"WebOS", "AppleTV", "CrKey", "BRAVIA", "AFT", "Roku"} {
+		if strings.Contains(ua, marker) {
+			return TV
+		}
+	}
+	for _, marker := range []string{"Mobi", "Android", "iPhone", "iPad"} {
+		if strings.Contains(ua, marker) {
+			return MOBILE
+		}
+	}
+	return DESKTOP
+}
+
+// Returns the profile requested via sc_profile, or nil if none was requested
+// (or the requested one doesn't exist).
+func RequestedProfile(r *http.Request) *Profile {
+	name := r.FormValue(PARAM_PROFILE)
+	if len(name) == 0 {
+		return nil
+	}
+	p, has := Profiles()[name]
+	if !has {
+		log.Println("Unknown transcode profile requested:", name)
+		return nil
+	}
+	return p
+}
+
+// Returns the profile to transcode with for r: the requested one if any,
+// otherwise the default for the client's device class. Clients that can't
+// play WebM get --fallback_profile instead of a WebM default.
+func ChooseProfile(r *http.Request) *Profile {
+	if p := RequestedProfile(r); p != nil {
+		return p
+	}
+	name := *desktop_profile
+	switch DeviceClass(r) {
+	case MOBILE:
+		name = *mobile_profile
+	case TV:
+		name = *tv_profile
+	}
+	p, has := Profiles()[name]
+	if !has {
+		log.Println("Default transcode profile", name, "not found; using",
+			DEFAULT_PROFILE)
+		p = Profiles()[DEFAULT_PROFILE]
+	}
+	if p.IsWebM() && !ClientCapabilities(r).Can("webm") {
+		if fallback, has := Profiles()[*fallback_profile]; has {
+			return fallback
+		}
+		log.Println("Fallback transcode profile", *fallback_profile, "not found")
+	}
+	return p
+}
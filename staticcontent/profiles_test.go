@@ -0,0 +1,50 @@
+package staticcontent
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestChooseProfile(t *testing.T) {
+	const (
+		chrome  = "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36"
+		safari  = "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.0 Safari/605.1.15"
+		iphone  = "Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.0 Mobile/15E148 Safari/604.1"
+		android = "Mozilla/5.0 (Linux; Android 14; Pixel 8) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Mobile Safari/537.36"
+		tv      = "Mozilla/5.0 (SMART-TV; Linux; Tizen 6.0) AppleWebKit/537.36 (KHTML, like Gecko) SamsungBrowser/4.0 Chrome/76.0 TV Safari/537.36"
+	)
+	tests := []struct {
+		ua      string
+		caps    string // Reported capabilities cookie, if any
+		profile string // Requested profile, if any
+		want    string
+	}{
+		{chrome, "", "", DEFAULT_PROFILE},
+		{iphone, "", "", "mobile-low"},
+		{android, "", "", "mobile-low"},
+		{tv, "", "", "h264-1080p"},
+
+		// The WebM default goes to clients that can't play WebM as the
+		// fallback instead.
+		{safari, "", "", "h264-1080p"},
+		{chrome, "mp4.h264.aac", "", "h264-1080p"},
+		{safari, "mp4.webm.h264.vp8", "", DEFAULT_PROFILE},
+
+		// Requested profiles win, if they exist.
+		{iphone, "", "webm-720p", "webm-720p"},
+		{safari, "", "audio-only", "audio-only"},
+		{chrome, "", "no-such-profile", DEFAULT_PROFILE},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/video.mkv?"+PARAM_PROFILE+"="+test.profile, nil)
+		r.Header.Set("User-Agent", test.ua)
+		if len(test.caps) > 0 {
+			r.AddCookie(&http.Cookie{Name: CAPS_COOKIE, Value: test.caps})
+		}
+		if got := ChooseProfile(r); got.Name != test.want {
+			t.Errorf("ChooseProfile(%q, caps %q, profile %q) = %v; want %v",
+				test.ua, test.caps, test.profile, got.Name, test.want)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package staticcontent
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var progress_file = flag.String("progress_file", stateFile("progress.json"),
+	"File watch progress is kept in between runs. It's ignored unless "+
+		"private to the user running WebCmd.")
+
+var (
+	// Records how far into the requested video the viewer is; POSTed by the
+	// player with PARAM_POSITION and PARAM_DURATION in seconds, and
+	// PARAM_WATCHED once it's finished.
+	MODE_PROGRESS = "progress"
+
+	PARAM_POSITION = "sc_position"
+	PARAM_DURATION = "sc_duration"
+	PARAM_WATCHED  = "sc_watched"
+
+	// Cookie identifying a viewer, so each has their own progress.
+	USER_COOKIE = "sc_user"
+
+	// Videos played this far through count as watched.
+	WATCHED_FRACTION = 0.9
+)
+
+// How far a viewer got through a video.
+type Progress struct {
+	Position float64   // Seconds from the start
+	Duration float64   // Length of the video in seconds, if known
+	Watched  bool      // Whether it was played to (nearly) the end
+	Updated  time.Time // When this was last reported
+}
+
+// The position to resume from, or 0 to start over.
+func (p *Progress) Resume() float64 {
+	if p == nil || p.Watched {
+		return 0
+	}
+	return p.Position
+}
+
+// A short description for listings, e.g. "watched" or "45%".
+func (p *Progress) Badge() string {
+	switch {
+	case p == nil:
+		return ""
+	case p.Watched:
+		return "watched"
+	case p.Duration > 0:
+		return fmt.Sprintf("%.0f%%", p.Position/p.Duration*100)
+	case p.Position > 0:
+		return "in progress"
+	}
+	return ""
+}
+
+// Watch progress of every viewer, by viewer id then video URL path, kept in
+// --progress_file.
+type progressStore struct {
+	lock   sync.Mutex
+	Users  map[string]map[string]*Progress
+	loaded bool
+}
+
+var progress = &progressStore{}
+
+// Loads the store from --progress_file if not yet loaded. Must be called with
+// the lock held.
+func (s *progressStore) load() {
+	if s.loaded {
+		return
+	}
+	s.loaded = true
+	if file, err := openPrivate(*progress_file); err == nil {
+		if err := json.NewDecoder(file).Decode(s); err != nil {
+			log.Println("Ignoring unreadable progress file", *progress_file+":", err)
+		}
+		file.Close()
+	} else if !os.IsNotExist(err) {
+		log.Println("Ignoring progress file", *progress_file+":", err)
+	}
+	if s.Users == nil {
+		s.Users = make(map[string]map[string]*Progress)
+	}
+}
+
+// Writes the store to --progress_file. Must be called with the lock held.
+func (s *progressStore) save() {
+	data, err := json.Marshal(s)
+	if err == nil {
+		err = writePrivate(*progress_file, func(w io.Writer) error {
+			_, err := w.Write(data)
+			return err
+		})
+	}
+	if err != nil {
+		log.Println("Failed to save watch progress to", *progress_file+":", err)
+	}
+}
+
+// Returns a copy of the user's progress through the video at urlPath, or nil
+// if they haven't played it.
+func (s *progressStore) get(user string, urlPath string) *Progress {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.load()
+	p, has := s.Users[user][urlPath]
+	if !has {
+		return nil
+	}
+	result := *p
+	return &result
+}
+
+// Records the user's progress through the video at urlPath.
+func (s *progressStore) set(user string, urlPath string, p Progress) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.load()
+	if s.Users[user] == nil {
+		s.Users[user] = make(map[string]*Progress)
+	}
+	s.Users[user][urlPath] = &p
+	s.save()
+}
+
+// Returns the viewer id of r, or "" if it has none.
+func viewer(r *http.Request) string {
+	if cookie, err := r.Cookie(USER_COOKIE); err == nil {
+		return cookie.Value
+	}
+	return ""
+}
+
+// Returns the viewer id of r, giving the client a new one if it has none.
+func ensureViewer(w http.ResponseWriter, r *http.Request) string {
+	if user := viewer(r); len(user) > 0 {
+		return user
+	}
+	user := randomHex(16)
+	http.SetCookie(w, &http.Cookie{Name: USER_COOKIE, Value: user, Path: "/",
+		MaxAge: 10 * 365 * 24 * 3600, HttpOnly: true})
+	return user
+}
+
+// Returns the progress of r's viewer through the video at urlPath, if any.
+func viewerProgress(r *http.Request, urlPath string) *Progress {
+	user := viewer(r)
+	if len(user) == 0 {
+		return nil
+	}
+	return progress.get(user, urlPath)
+}
+
+// Handler recording the viewer's progress through the requested video.
+func (f *FileHandler) ServeProgress(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Progress must be POSTed.", http.StatusMethodNotAllowed)
+		return
+	}
+	position, err := strconv.ParseFloat(r.FormValue(PARAM_POSITION), 64)
+	if err != nil || position < 0 {
+		http.Error(w, "Invalid position.", http.StatusBadRequest)
+		return
+	}
+	duration, _ := strconv.ParseFloat(r.FormValue(PARAM_DURATION), 64)
+	p := Progress{Position: position, Duration: duration, Updated: time.Now(),
+		Watched: len(r.FormValue(PARAM_WATCHED)) > 0 ||
+			(duration > 0 && position >= duration*WATCHED_FRACTION)}
+	progress.set(ensureViewer(w, r), f.PathPrefix+r.URL.Path, p)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Formats seconds as a position for people, e.g. "1:02:03" or "2:03".
+func formatPosition(seconds float64) string {
+	s := int(seconds)
+	if s >= 3600 {
+		return fmt.Sprintf("%d:%02d:%02d", s/3600, s/60%60, s%60)
+	}
+	return fmt.Sprintf("%d:%02d", s/60, s%60)
+}
@@ -0,0 +1,127 @@
+package staticcontent
+
+import (
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"sort"
+)
+
+var (
+	// Plays every video and audio file in the requested directory in order,
+	// starting from the first the viewer hasn't watched.
+	MODE_PLAY = "play"
+
+	// Starts playing as soon as the player opens, and moves on to the next
+	// file in the folder when one finishes.
+	PARAM_AUTOPLAY = "sc_autoplay"
+)
+
+// A file in the player's queue: the playable files of its folder.
+type queueEntry struct {
+	Name    string
+	Url     string
+	Badge   string // The viewer's progress through it, if any
+	Current bool   // Whether it's the file being played
+}
+
+// The playable files in the folder of the file being played, for the
+// players' queues.
+type folderQueue struct {
+	PrevUrl string       // Player URL of the previous file in the folder
+	NextUrl string       // Player URL of the next file in the folder
+	Queue   []queueEntry // The files in the folder, if more than one
+}
+
+// Whether name opens in one of the players.
+func isPlayable(name string) bool {
+	return IsVideo(name) || IsAudio(name)
+}
+
+// Returns the names of the playable files in the directory at dir, in
+// natural order.
+func (f *FileHandler) playable(dir string) []string {
+	files, err := f.listDir(dir)
+	if err != nil {
+		return nil
+	}
+	names := []string{}
+	for _, file := range files {
+		if !file.IsDir() && isPlayable(file.Name()) {
+			names = append(names, file.Name())
+		}
+	}
+	sort.Slice(names, func(i, j int) bool { return naturalLess(names[i], names[j]) })
+	return names
+}
+
+// Returns the player URL of the sibling file name, relative to the player
+// page, keeping the requested transcode profile. The page adds
+// PARAM_AUTOPLAY itself, as the viewer can turn it on and off.
+func siblingUrl(r *http.Request, name string) string {
+	// "./" keeps names like "a:b.mkv" from being read as URL schemes.
+	u := "./" + url.PathEscape(name)
+	if profile := r.FormValue(PARAM_PROFILE); len(profile) > 0 {
+		u += "?" + PARAM_PROFILE + "=" + url.QueryEscape(profile)
+	}
+	return u
+}
+
+// Returns the queue for the file at p: the other playable files in its
+// folder, and which come before and after it.
+func (f *FileHandler) queueFor(r *http.Request, p string) folderQueue {
+	q := folderQueue{}
+	current := filepath.Base(p)
+	urlDir := path.Join(f.PathPrefix, path.Dir("/"+r.URL.Path))
+	names := []string{}
+	for _, name := range f.playable(filepath.Dir(p)) {
+		// Visitors with a share of just this file can't open the others.
+		if name == current || f.canView(r, path.Join(urlDir, name)) {
+			names = append(names, name)
+		}
+	}
+	if len(names) < 2 {
+		return q
+	}
+	for i, name := range names {
+		e := queueEntry{Name: name, Url: siblingUrl(r, name),
+			Badge:   viewerProgress(r, path.Join(urlDir, name)).Badge(),
+			Current: name == current}
+		if e.Current {
+			if i > 0 {
+				q.PrevUrl = siblingUrl(r, names[i-1])
+			}
+			if i+1 < len(names) {
+				q.NextUrl = siblingUrl(r, names[i+1])
+			}
+		}
+		q.Queue = append(q.Queue, e)
+	}
+	return q
+}
+
+// Handler for playing a whole folder: redirects to the player for its first
+// unwatched file (or the first, if all are watched), with autoplay on.
+func (f *FileHandler) ServePlayFolder(w http.ResponseWriter, r *http.Request) {
+	dir, err := f.localPath(r)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	names := f.playable(dir)
+	if len(names) == 0 {
+		http.Error(w, "Nothing to play.", http.StatusNotFound)
+		return
+	}
+	urlDir := path.Join(f.PathPrefix, "/"+r.URL.Path)
+	start := names[0]
+	for _, name := range names {
+		if p := viewerProgress(r, path.Join(urlDir, name)); p == nil || !p.Watched {
+			start = name
+			break
+		}
+	}
+	http.Redirect(w, r, escapePath(path.Join(urlDir, start))+"?"+PARAM_AUTOPLAY+"=1",
+		http.StatusFound)
+}
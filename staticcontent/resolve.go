@@ -0,0 +1,184 @@
+package staticcontent
+
+import (
+	"errors"
+	"flag"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var symlinks = flag.String("symlinks", SYMLINKS_WITHIN,
+	"How symlinks in static content roots are followed: \"deny\" (never), "+
+		"\"within\" (only to targets inside the same root) or \"allow\" "+
+		"(anywhere). Roots can override this with a symlinks= option.")
+
+var (
+	SYMLINKS_DENY   = "deny"
+	SYMLINKS_WITHIN = "within"
+	SYMLINKS_ALLOW  = "allow"
+)
+
+var symlinkPolicies = map[string]bool{
+	SYMLINKS_DENY: true, SYMLINKS_WITHIN: true, SYMLINKS_ALLOW: true,
+}
+
+var errInvalidPath = errors.New("Invalid path.")
+
+// Returns the symlink policy of the root.
+func (f *FileHandler) symlinkPolicy() string {
+	if len(f.Options.Symlinks) > 0 {
+		return f.Options.Symlinks
+	}
+	if !symlinkPolicies[*symlinks] {
+		log.Println("Unknown --symlinks policy", *symlinks+"; using", SYMLINKS_WITHIN)
+		return SYMLINKS_WITHIN
+	}
+	return *symlinks
+}
+
+// Whether the OS path p is root or inside it. Both must be clean.
+func within(p string, root string) bool {
+	prefix := root
+	if !strings.HasSuffix(prefix, string(filepath.Separator)) {
+		prefix += string(filepath.Separator)
+	}
+	return p == root || strings.HasPrefix(p, prefix)
+}
+
+// Returns the OS path of the slash-separated path rel within the root, or an
+// error if it would fall outside of it. Every mode resolves paths through
+// here: ".." can't climb out of the root, symlinks along the way are
+// followed only as the root's symlink policy allows, and paths the root's
+// ignore rules hide and our own files (the trash, partial uploads) aren't
+// found. Paths that don't exist yet (e.g. for uploads) are checked as far as
+// they do.
+func (f *FileHandler) osPath(rel string) (string, error) {
+	root := filepath.Clean(f.OSPath)
+	p := filepath.Clean(filepath.Join(root, filepath.FromSlash(rel)))
+	if !within(p, root) {
+		log.Println("Trying to open path outside filesystem root:", p, "not in", root)
+		return "", errInvalidPath
+	}
+	for q := p; q != root; q = filepath.Dir(q) {
+		if isInternalName(filepath.Base(q)) {
+			log.Println("Refusing internal path", p)
+			return "", errInvalidPath
+		}
+	}
+	if err := f.checkSymlinks(p); err != nil {
+		log.Println("Refusing", p+":", err)
+		return "", errInvalidPath
+	}
+	if f.Options.HideDotfiles || len(f.Options.Ignore) > 0 {
+		stat, err := os.Stat(p)
+		if f.ignoredPath(p, err == nil && stat.IsDir()) {
+			log.Println("Refusing ignored path", p)
+			return "", errInvalidPath
+		}
+	}
+	return p, nil
+}
+
+// Checks the symlinks in the OS path p, which is lexically inside the root,
+// against the root's symlink policy. The root itself may be a symlink.
+func (f *FileHandler) checkSymlinks(p string) error {
+	policy := f.symlinkPolicy()
+	if policy == SYMLINKS_ALLOW {
+		return nil
+	}
+	root := filepath.Clean(f.OSPath)
+	// Only the part of the path that exists can contain symlinks.
+	existing := p
+	for existing != root {
+		if _, err := os.Lstat(existing); err == nil {
+			break
+		}
+		existing = filepath.Dir(existing)
+	}
+	if policy == SYMLINKS_DENY {
+		for q := existing; q != root; q = filepath.Dir(q) {
+			if stat, err := os.Lstat(q); err == nil && stat.Mode()&os.ModeSymlink != 0 {
+				return errors.New("Symlinks aren't followed.")
+			}
+		}
+		return nil
+	}
+	resolvedRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return err
+	}
+	resolved, err := filepath.EvalSymlinks(existing)
+	if err != nil {
+		// A dangling symlink; its target can't be checked.
+		return err
+	}
+	if !within(resolved, resolvedRoot) {
+		return errors.New("Symlink leads outside the root, to " + resolved + ".")
+	}
+	return nil
+}
+
+// An http.FileSystem serving a root's files, resolved as for every other
+// mode, so the fallback http.FileServer can't be led out of the root.
+type rootFS struct {
+	f *FileHandler
+}
+
+func (fs rootFS) Open(name string) (http.File, error) {
+	p, err := fs.f.osPath(name)
+	if err != nil {
+		return nil, os.ErrNotExist
+	}
+	file, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	return &rootFile{File: file, f: fs.f, osPath: p}, nil
+}
+
+// A file opened through rootFS. Directories list only what the root's
+// listings show, so the fallback http.FileServer doesn't reveal ignored,
+// internal or off-limits entries.
+type rootFile struct {
+	http.File
+	f       *FileHandler
+	osPath  string
+	entries []os.FileInfo // Listed on the first Readdir, then handed out in turn
+	listed  bool
+}
+
+func (file *rootFile) Readdir(count int) ([]os.FileInfo, error) {
+	if !file.listed {
+		entries, err := file.f.listDir(file.osPath)
+		if err != nil {
+			return nil, err
+		}
+		file.entries, file.listed = entries, true
+	}
+	if count <= 0 {
+		entries := file.entries
+		file.entries = nil
+		return entries, nil
+	}
+	if len(file.entries) == 0 {
+		return nil, io.EOF
+	}
+	if count > len(file.entries) {
+		count = len(file.entries)
+	}
+	entries := file.entries[:count]
+	file.entries = file.entries[count:]
+	return entries, nil
+}
+
+// Returns a FileHandler serving root under prefix.
+func newFileHandler(prefix string, root string, opts RootOptions, server *Server) *FileHandler {
+	f := &FileHandler{PathPrefix: prefix, OSPath: root, Options: opts, server: server,
+		limiter: &limiter{rate: opts.Bandwidth}}
+	f.FallbackHandler = http.FileServer(rootFS{f})
+	return f
+}
@@ -0,0 +1,157 @@
+package staticcontent
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Creates a root with a file, a subdirectory, our own files and symlinks
+// within, out of and nowhere, next to a directory outside it.
+func testRoot(t *testing.T) (root string, outside string) {
+	dir := t.TempDir()
+	root = filepath.Join(dir, "root")
+	outside = filepath.Join(dir, "outside")
+	for _, d := range []string{root, outside, filepath.Join(root, "sub"),
+		filepath.Join(root, trashDirName, "1")} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{filepath.Join(root, "a.txt"), filepath.Join(root, "sub", "b.txt"),
+		filepath.Join(root, partialUploadPrefix+"abc"), filepath.Join(outside, "secret.txt")} {
+		if err := ioutil.WriteFile(name, []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for link, target := range map[string]string{
+		"inlink":   filepath.Join(root, "sub"),
+		"outlink":  outside,
+		"dangling": filepath.Join(root, "missing"),
+	} {
+		if err := os.Symlink(target, filepath.Join(root, link)); err != nil {
+			t.Skip("Symlinks unsupported:", err)
+		}
+	}
+	return root, outside
+}
+
+func TestOsPath(t *testing.T) {
+	root, _ := testRoot(t)
+	tests := []struct {
+		rel    string
+		policy string
+		want   string // OS path relative to the root; "" for an error
+	}{
+		{"a.txt", SYMLINKS_WITHIN, "a.txt"},
+		{"sub/b.txt", SYMLINKS_WITHIN, "sub/b.txt"},
+		{"", SYMLINKS_WITHIN, "."},
+		{"new/file.txt", SYMLINKS_WITHIN, "new/file.txt"},
+
+		// ".." can't climb out of the root.
+		{"../outside/secret.txt", SYMLINKS_ALLOW, ""},
+		{"sub/../../outside/secret.txt", SYMLINKS_ALLOW, ""},
+		{"/../outside/secret.txt", SYMLINKS_ALLOW, ""},
+		{"sub/../a.txt", SYMLINKS_WITHIN, "a.txt"},
+
+		// Encoded separators arrive decoded only once, so they're just odd
+		// names inside the root.
+		{"..%2foutside%2fsecret.txt", SYMLINKS_WITHIN, "..%2foutside%2fsecret.txt"},
+		{"%2e%2e/outside/secret.txt", SYMLINKS_WITHIN, "%2e%2e/outside/secret.txt"},
+
+		// Our own files are never found.
+		{trashDirName, SYMLINKS_WITHIN, ""},
+		{trashDirName + "/1", SYMLINKS_WITHIN, ""},
+		{partialUploadPrefix + "abc", SYMLINKS_WITHIN, ""},
+		{"sub/" + partialUploadPrefix + "new", SYMLINKS_WITHIN, ""},
+		{trashDirName + "x", SYMLINKS_WITHIN, trashDirName + "x"},
+
+		// Symlinks are followed as the policy allows.
+		{"inlink/b.txt", SYMLINKS_WITHIN, "inlink/b.txt"},
+		{"inlink/b.txt", SYMLINKS_DENY, ""},
+		{"inlink/b.txt", SYMLINKS_ALLOW, "inlink/b.txt"},
+		{"outlink/secret.txt", SYMLINKS_WITHIN, ""},
+		{"outlink/secret.txt", SYMLINKS_DENY, ""},
+		{"outlink/secret.txt", SYMLINKS_ALLOW, "outlink/secret.txt"},
+		{"outlink/new.txt", SYMLINKS_WITHIN, ""},
+		{"dangling", SYMLINKS_WITHIN, ""},
+		{"dangling", SYMLINKS_ALLOW, "dangling"},
+	}
+	for _, test := range tests {
+		f := &FileHandler{OSPath: root, Options: RootOptions{Symlinks: test.policy}}
+		got, err := f.osPath(test.rel)
+		if len(test.want) == 0 {
+			if err == nil {
+				t.Errorf("osPath(%q) with symlinks=%v = %q; want an error", test.rel, test.policy, got)
+			}
+			continue
+		}
+		want := filepath.Join(root, filepath.FromSlash(test.want))
+		if err != nil || got != want {
+			t.Errorf("osPath(%q) with symlinks=%v = %q, %v; want %q", test.rel, test.policy, got, err, want)
+		}
+	}
+}
+
+func TestCheckSymlinks(t *testing.T) {
+	root, _ := testRoot(t)
+	tests := []struct {
+		rel    string
+		policy string
+		ok     bool
+	}{
+		{"a.txt", SYMLINKS_DENY, true},
+		{"sub/b.txt", SYMLINKS_DENY, true},
+		{"sub/missing/new.txt", SYMLINKS_DENY, true},
+		{"inlink", SYMLINKS_DENY, false},
+		{"inlink", SYMLINKS_WITHIN, true},
+		{"inlink/missing.txt", SYMLINKS_WITHIN, true},
+		{"outlink", SYMLINKS_WITHIN, false},
+		{"outlink/secret.txt", SYMLINKS_WITHIN, false},
+		{"outlink/missing/new.txt", SYMLINKS_WITHIN, false},
+		{"outlink/secret.txt", SYMLINKS_ALLOW, true},
+		{"dangling", SYMLINKS_DENY, false},
+		{"dangling", SYMLINKS_WITHIN, false},
+	}
+	for _, test := range tests {
+		f := &FileHandler{OSPath: root, Options: RootOptions{Symlinks: test.policy}}
+		err := f.checkSymlinks(filepath.Join(root, filepath.FromSlash(test.rel)))
+		if (err == nil) != test.ok {
+			t.Errorf("checkSymlinks(%q) with symlinks=%v = %v; want ok=%v", test.rel, test.policy, err, test.ok)
+		}
+	}
+}
+
+// A root whose own path goes through a symlink still serves its files.
+func TestCheckSymlinksLinkedRoot(t *testing.T) {
+	root, _ := testRoot(t)
+	linked := filepath.Join(filepath.Dir(root), "linked")
+	if err := os.Symlink(root, linked); err != nil {
+		t.Skip("Symlinks unsupported:", err)
+	}
+	for _, policy := range []string{SYMLINKS_DENY, SYMLINKS_WITHIN} {
+		f := &FileHandler{OSPath: linked, Options: RootOptions{Symlinks: policy}}
+		if _, err := f.osPath("sub/b.txt"); err != nil {
+			t.Errorf("osPath through a linked root with symlinks=%v: %v", policy, err)
+		}
+		if _, err := f.osPath("outlink/secret.txt"); err == nil {
+			t.Errorf("osPath escaped a linked root with symlinks=%v", policy)
+		}
+	}
+}
+
+// Where the filesystem ignores case, other spellings of our own files are
+// refused too.
+func TestOsPathFoldsInternalNames(t *testing.T) {
+	root, _ := testRoot(t)
+	defer func(saved func(string) string) { canonicalName = saved }(canonicalName)
+	canonicalName = func(name string) string { return strings.ToLower(strings.TrimRight(name, ". ")) }
+	f := &FileHandler{OSPath: root}
+	for _, rel := range []string{".WEBCMD-TRASH/1", ".Webcmd-Trash./1", "sub/.WEBCMD-UPLOAD-abc"} {
+		if got, err := f.osPath(rel); err == nil {
+			t.Errorf("osPath(%q) = %q; want an error", rel, got)
+		}
+	}
+}
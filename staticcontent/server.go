@@ -1,6 +1,7 @@
 package staticcontent
 
 import (
+	"crypto/sha1"
 	"errors"
 	"flag"
 	"fmt"
@@ -10,11 +11,13 @@ import (
 	"log"
 	"net/http"
 	"net/url"
+	"os"
 	"os/exec"
 	"path"
 	"path/filepath"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -45,6 +48,7 @@ var verbose_transcode_output = flag.Bool("verbose_transcode_output", false,
 var (
 	PARAM_MODE     = "sc_mode"
 	MODE_RAW       = "raw"
+	MODE_REMUX     = "remux"
 	MODE_TRANSCODE = "transcode"
 
 	PARAM_SEEK = "sc_seek"
@@ -58,20 +62,34 @@ type Server struct {
 	prefix         string
 	httpServer     http.Server
 	installedPaths map[string]string
+	handlers       map[string]*FileHandler // By URL path of each root
+	index          *Index
 }
 
 // Creates a new Server. On request, this object will install new
 // file system handlers under prefix. E.g. if prefix is /static, it may install
 // handlers for /static/first and /static/second.
+// WebDAV access to every root is installed under DAV_PREFIX, and the
+// share-management page at SHARES_PATH.
 func NewServer(prefix string, httpServer http.Server) *Server {
-	return &Server{prefix: prefix, httpServer: httpServer, installedPaths: make(map[string]string)}
+	server := &Server{prefix: prefix, httpServer: httpServer,
+		installedPaths: make(map[string]string),
+		handlers:       make(map[string]*FileHandler), index: NewIndex()}
+	http.Handle(DAV_PREFIX+"/", RequireAuth(&davHandler{server}))
+	http.Handle(SHARES_PATH, RequireAuth(&sharesHandler{server}))
+	return server
 }
 
-// Install a specific filesystem tree under a named path. This path will
-// be nested under the prefix this server uses for all paths.
+// Install a specific filesystem tree under a named path, with default options.
+// This path will be nested under the prefix this server uses for all paths.
 // If the filesystem tree cannot be used or the path collides with an existing
 // path, an error is returned instead.
 func (server *Server) Install(name string, root string) error {
+	return server.InstallWithOptions(name, root, RootOptions{})
+}
+
+// Like Install, but with the given options for the root.
+func (server *Server) InstallWithOptions(name string, root string, opts RootOptions) error {
 	p := path.Join(server.prefix, name) + "/"
 	log.Println("Attempting to install static content server for", root, "at", p)
 	if old_root, has := server.installedPaths[p]; has {
@@ -86,10 +104,11 @@ func (server *Server) Install(name string, root string) error {
 			return err
 		}
 	}
-	httpRoot := http.Dir(root)
-	fileServer := &FileHandler{p, root, http.FileServer(httpRoot)}
-	http.Handle(p, http.StripPrefix(p, fileServer))
+	fileServer := newFileHandler(p, root, opts, server)
+	http.Handle(p, server.guard(http.StripPrefix(p, fileServer)))
 	server.installedPaths[p] = root
+	server.handlers[p] = fileServer
+	server.index.AddRoot(fileServer)
 	log.Println("Server installation successful")
 	return nil
 }
@@ -106,6 +125,27 @@ func (server *Server) Roots() []string {
 	return roots
 }
 
+// Starts keeping the search index of all installed roots up to date in the
+// background.
+func (server *Server) StartIndexing() {
+	go server.index.Run()
+}
+
+// Searches the names and paths of files in all roots. See ParseSearch for the
+// query syntax.
+func (server *Server) Search(query string) ([]IndexEntry, error) {
+	q, err := ParseSearch(query)
+	if err != nil {
+		return nil, err
+	}
+	return server.index.Search(q), nil
+}
+
+// Searches the contents of text files in all roots, if --text_index is set.
+func (server *Server) FindText(query string) ([]TextMatch, error) {
+	return server.index.FindText(query)
+}
+
 // Helper implementing io.Writer to stream writes to a given channel. If the
 // channel is full writes will be blocked until there is room.
 type ChannelWriter struct {
@@ -132,77 +172,252 @@ type FileHandler struct {
 	PathPrefix      string
 	OSPath          string
 	FallbackHandler http.Handler
+	Options         RootOptions
+	server          *Server  // The server it's installed on, for moves between roots
+	limiter         *limiter // Bandwidth limit of the root
 }
 
 // Handler for serving file requests. Uses the url parameter sc_mode to force
-// certain behaviours - "raw" to serve the file with no wrapper, and "transcode"
-// to serve a transcoded version of a video.
+// certain behaviours - "raw" to serve the file with no wrapper, "remux" to
+// serve a video's streams in a web-friendly container, "transcode" to serve a
+// transcoded version of a video or audio file, and "subs" to serve one of its
+// subtitle tracks as WebVTT. "thumb" serves a thumbnail of a video or image
+// (or an audio file's cover art), and "trickplay" and "sprite" its seek-bar
+// previews. Directories get a templated listing, or http.FileServer's plain
+// one with "raw". "json" (or an Accept header asking for JSON) describes the
+// file or directory as JSON instead.
+// "upload", "upload_chunk" and "upload_status" add files to writable roots,
+// and "mkdir", "rename", "move", "delete", "trash" and "restore" manage them.
+// "zip" and "tar" download a directory as an archive, "share" mints a share
+// link for the file or directory, "progress" records how far into a video
+// the viewer is, and "play" plays a directory's videos and audio in order.
+// "m3u" and "xspf" list a directory's media as a playlist. Paths inside
+// archives, like site.zip/!/index.html, are served from the archive. Other
+// videos and audio files get a player page.
 func (f *FileHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	logRequest(r)
-	if r.FormValue(PARAM_MODE) == MODE_RAW {
-		f.FallbackHandler.ServeHTTP(w, r)
+	w, done := f.throttle(w, r)
+	defer done()
+	if archive, member, ok := splitArchivePath(r.URL.Path); ok {
+		f.ServeArchiveMember(w, r, archive, member)
 		return
 	}
-	if r.FormValue(PARAM_MODE) == MODE_TRANSCODE {
+	// Only the URL is consulted, so upload bodies aren't read here.
+	switch r.URL.Query().Get(PARAM_MODE) {
+	case MODE_RAW:
+		f.serveFallback(w, r)
+		return
+	case MODE_TRANSCODE:
 		f.TranscodeAndServe(w, r)
 		return
+	case MODE_REMUX:
+		f.RemuxAndServe(w, r)
+		return
+	case MODE_SUBTITLES:
+		f.ServeSubtitles(w, r)
+		return
+	case MODE_THUMBNAIL:
+		f.ServeThumbnail(w, r)
+		return
+	case MODE_TRICKPLAY:
+		f.ServeTrickplayTrack(w, r)
+		return
+	case MODE_SPRITE:
+		f.ServeSprite(w, r)
+		return
+	case MODE_UPLOAD:
+		f.ServeUpload(w, r)
+		return
+	case MODE_UPLOAD_CHUNK:
+		f.ServeUploadChunk(w, r)
+		return
+	case MODE_UPLOAD_STATUS:
+		f.ServeUploadStatus(w, r)
+		return
+	case MODE_MKDIR, MODE_RENAME, MODE_MOVE, MODE_DELETE, MODE_RESTORE:
+		f.ServeFileOp(w, r)
+		return
+	case MODE_TRASH:
+		f.ServeTrash(w, r)
+		return
+	case MODE_ZIP, MODE_TAR:
+		f.ServeArchive(w, r)
+		return
+	case MODE_SHARE:
+		f.ServeShare(w, r)
+		return
+	case MODE_PROGRESS:
+		f.ServeProgress(w, r)
+		return
+	case MODE_PLAY:
+		f.ServePlayFolder(w, r)
+		return
+	case MODE_M3U, MODE_XSPF:
+		f.ServePlaylist(w, r)
+		return
+	}
+	if wantsJSON(r) {
+		f.ServeJSON(w, r)
+		return
 	}
 	upath := r.URL.Path
-	last := strings.LastIndex(upath, ".")
-	if last >= 0 {
-		suffix := upath[last+1:]
-		switch i := strings.ToLower(suffix); i {
-		case "mp4":
-			{
-				if *custom_video_player {
-					f.ServeVideoPlayer("mp4", false, w, r)
-				} else {
-					f.FallbackHandler.ServeHTTP(w, r)
-				}
-				return
-			}
-		case "mkv", "avi", "wmv":
-			{
-				if *custom_video_player {
-					if *transcode {
-						f.ServeVideoPlayer(*transcode_content_type, true, w, r)
-					} else {
-						f.ServeVideoPlayer(i, false, w, r)
-					}
-				} else {
-					if *transcode {
-						f.TranscodeAndServe(w, r)
-					} else {
-						f.FallbackHandler.ServeHTTP(w, r)
-					}
+	if p, err := f.localPath(r); err == nil {
+		if stat, err := os.Stat(p); err == nil && stat.IsDir() {
+			if len(upath) > 0 && !strings.HasSuffix(upath, "/") {
+				// Relative links in the listing need the trailing slash.
+				target := f.PathPrefix + upath + "/"
+				if len(r.URL.RawQuery) > 0 {
+					target += "?" + r.URL.RawQuery
 				}
+				http.Redirect(w, r, target, http.StatusMovedPermanently)
 				return
 			}
+			f.ServeListing(w, r)
+			return
+		}
+	}
+	if IsVideo(upath) {
+		d := f.Decide(extension(upath), r)
+		if *custom_video_player {
+			f.ServeVideoPlayer(d, w, r)
+			return
 		}
+		switch d.Method {
+		case Remux:
+			f.RemuxAndServe(w, r)
+		case Transcode:
+			f.TranscodeAndServe(w, r)
+		default:
+			f.serveFallback(w, r)
+		}
+		return
+	}
+	if IsAudio(upath) {
+		d := f.DecideAudio(extension(upath), r)
+		if *custom_audio_player {
+			f.ServeAudioPlayer(d, w, r)
+		} else if d.Method == Transcode {
+			f.TranscodeAndServe(w, r)
+		} else {
+			f.serveFallback(w, r)
+		}
+		return
 	}
 
-	f.FallbackHandler.ServeHTTP(w, r)
+	f.serveFallback(w, r)
 	return
 }
 
+// Serves r with the FallbackHandler. Files get a strong ETag derived from
+// their path, size and modification time, so conditional and range requests
+// can be validated without reading them.
+func (f *FileHandler) serveFallback(w http.ResponseWriter, r *http.Request) {
+	if p, err := f.localPath(r); err == nil {
+		if stat, err := os.Stat(p); err == nil && stat.Mode().IsRegular() {
+			w.Header().Set("ETag", fileETag(p, stat))
+		}
+	}
+	f.FallbackHandler.ServeHTTP(w, r)
+}
+
+// Returns the ETag of the file at p.
+func fileETag(p string, stat os.FileInfo) string {
+	sum := sha1.Sum([]byte(fmt.Sprintf("%v|%v|%v", p, stat.Size(), stat.ModTime().UnixNano())))
+	return fmt.Sprintf(`"%x"`, sum[:12])
+}
+
+// Returns the OS path of the file requested by r, or an error if it would
+// fall outside of the filesystem root.
+func (f *FileHandler) localPath(r *http.Request) (string, error) {
+	return f.osPath(r.URL.Path)
+}
+
+// Decides how the video requested by r (with extension ext) should be served,
+// based on its probed codecs and what the client reports it can play. If the
+// client asked for a specific transcode profile, it's always transcoded.
+func (f *FileHandler) Decide(ext string, r *http.Request) Decision {
+	if !*transcode {
+		return Decision{Method: DirectPlay, Container: ext}
+	}
+	profile := ChooseProfile(r)
+	var info *MediaInfo
+	var audio *Stream
+	if videoPath, err := f.localPath(r); err == nil {
+		if info, err = Probe(videoPath); err == nil {
+			audio = ChooseAudio(r, info)
+		}
+	}
+	if RequestedProfile(r) != nil {
+		return Decide(ext, nil, audio, ClientCaps{}, profile)
+	}
+	d := Decide(ext, info, audio, ClientCapabilities(r), profile)
+	log.Println("Serving", r.URL.Path, "as", d.Mode(), d.Container)
+	return d
+}
+
 // Handler for serving transcoded files. The file path is taken from the
-// http.Request. Files are assumed to be valid videos; anything that can't be
-// transcoded will result in an empty stream or an error message.
+// http.Request, and the transcode profile from sc_profile (or the client's
+// device class, or for audio files what it can play). Files are assumed to be
+// valid media; anything that can't be transcoded will result in an empty
+// stream or an error message.
 func (f *FileHandler) TranscodeAndServe(w http.ResponseWriter, r *http.Request) {
+	if IsAudio(r.URL.Path) {
+		profile := ChooseAudioProfile(r)
+		log.Println("Transcoding audio with profile", profile.Name)
+		f.streamTranscoder(w, r, profile.Args(), profile.ContentType)
+		return
+	}
+	profile := ChooseProfile(r)
+	log.Println("Transcoding with profile", profile.Name)
+	args := profile.Args()
+	if videoPath, err := f.localPath(r); err == nil {
+		if info, err := Probe(videoPath); err == nil {
+			args = append(audioMapArgs(ChooseAudio(r, info)), args...)
+		}
+	}
+	f.streamTranscoder(w, r, args, profile.ContentType)
+}
+
+// Handler for serving remuxed files: the video stream is copied into a
+// container the client can play, and the audio re-encoded only if needed.
+// The file path is taken from the http.Request.
+func (f *FileHandler) RemuxAndServe(w http.ResponseWriter, r *http.Request) {
+	videoPath, err := f.localPath(r)
+	if err != nil {
+		w.Write([]byte("Error: " + err.Error()))
+		return
+	}
+	info, err := Probe(videoPath)
+	if err != nil {
+		// Can't tell what's in the file; a full transcode is all that's left.
+		f.TranscodeAndServe(w, r)
+		return
+	}
+	ext := strings.TrimPrefix(filepath.Ext(videoPath), ".")
+	audio := ChooseAudio(r, info)
+	d := Decide(ext, info, audio, ClientCapabilities(r), ChooseProfile(r))
+	if d.Method != Remux {
+		// The client could be reporting different capabilities than when
+		// the player page was served; insist on a container it can play.
+		d = Decision{Method: Remux, Container: "mp4", Audio: audio}
+	}
+	f.streamTranscoder(w, r, remuxArgs(d), d.ContentType())
+}
+
+// Runs the transcoder over the requested file with the given output arguments
+// and streams its output to w as contentType.
+func (f *FileHandler) streamTranscoder(w http.ResponseWriter, r *http.Request, outputArgs []string, contentType string) {
 	defer func() {
 		if r := recover(); r != nil {
 			log.Println("Recovered from transcode crash:", r)
 		}
 	}()
-	videoPath := filepath.Clean(filepath.Join(f.OSPath, r.URL.Path))
-	rootPath := filepath.Clean(f.OSPath) + string(filepath.Separator)
-	if videoPath[:len(rootPath)] != rootPath {
-		log.Println("Trying to open path outside filesystem root:", videoPath, "not in", rootPath)
-		w.Write([]byte("Error: invalid path."))
+	videoPath, err := f.localPath(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
 
-	transcodeSettings := strings.Split(*transcode_settings, " ")
 	args := []string{}
 	// (Optional) seek position
 	seek := r.FormValue(PARAM_SEEK)
@@ -217,12 +432,12 @@ func (f *FileHandler) TranscodeAndServe(w http.ResponseWriter, r *http.Request)
 	// Input file
 	args = append(args, *transcode_input_flag, videoPath)
 	// Extra transcode settings and output specifier.
-	args = append(args, transcodeSettings...)
+	args = append(args, outputArgs...)
 	cmd := exec.Command(*transcoder, args...)
 	platform.Hide(cmd)
 	log.Println("Calling", cmd.Path, cmd.Args)
 
-	w.Header().Set("Content-Type", "video/"+*transcode_content_type)
+	w.Header().Set("Content-Type", contentType)
 	c := make(chan []byte, 100)
 	defer close(c)
 	cmd.Stdout = &ChannelWriter{c}
@@ -238,7 +453,7 @@ func (f *FileHandler) TranscodeAndServe(w http.ResponseWriter, r *http.Request)
 			}
 		}()
 	}
-	err := cmd.Start()
+	err = cmd.Start()
 	done := false
 	go func() {
 		cmd.Wait()
@@ -292,46 +507,115 @@ type videoData struct {
 	Url          string
 	DownloadUrl  string
 	TranscodeUrl string
-	Type         string
+	Type         string   // Full MIME type of the stream at Url
+	NeedCaps     bool     // Whether the page should report client capabilities
+	Seek         string   // The requested seek position, if any
+	Profile      string   // The explicitly requested transcode profile, if any
+	Profiles     []string // All transcode profiles available
+	Poster       string   // Thumbnail URL to show before playback
+	Subtitles    []SubtitleTrack
+	Trickplay    string       // Seek-bar preview track URL, once generated
+	Duration     float64      // Length of the stream at Url in seconds, if known
+	AudioTracks  []AudioTrack // Listed only if there's a choice to make
+	ProgressUrl  string       // Where playback position is reported
+	Offset       float64      // Position in the video the stream at Url starts at
+	Total        float64      // Length of the whole video in seconds, if known
+	Direct       bool         // Whether the stream at Url is the file itself
+	Resume       float64      // Where the viewer left off, if they did
+	ResumeLabel  string       // Resume, for people
+	ResumeUrl    string       // Player URL starting at Resume, for transcodes
+	Autoplay     bool         // Whether to start playing, and go on to NextUrl
+	folderQueue
 }
 
 var VIDEO_TEMPLATE_FILE = "templates/video.html.template"
 
 // Serves a video player wrapper around a file (via the request URL). The video
-// type is set as t. If transcode is true, the video URL will point to the
-// transcode handler, otherwise the raw file handler.
-func (f *FileHandler) ServeVideoPlayer(t string, transcode bool, w http.ResponseWriter, r *http.Request) {
+// URL will point to the raw file, remux or transcode handler as decided by d.
+func (f *FileHandler) ServeVideoPlayer(d Decision, w http.ResponseWriter, r *http.Request) {
 	template_content, err := resources.Load(VIDEO_TEMPLATE_FILE)
 	if err != nil {
-		f.FallbackHandler.ServeHTTP(w, r)
+		f.serveFallback(w, r)
+		return
 	}
 
 	var videoTemplate = template.New("Video template")
 	videoTemplate, err = videoTemplate.Parse(string(template_content))
 	if err != nil {
-		f.FallbackHandler.ServeHTTP(w, r)
+		f.serveFallback(w, r)
+		return
 	}
 
 	// If copyable params are set, replicate them to the destination.
-	base_params := url.Values{}
-	if len(r.FormValue(PARAM_SEEK)) > 0 {
-		base_params.Set(PARAM_SEEK, r.FormValue(PARAM_SEEK))
+	modeUrl := func(mode string) string {
+		params := url.Values{}
+		for _, param := range []string{PARAM_SEEK, PARAM_PROFILE, PARAM_AUDIO} {
+			if len(r.FormValue(param)) > 0 {
+				params.Set(param, r.FormValue(param))
+			}
+		}
+		params.Set(PARAM_MODE, mode)
+		return "?" + params.Encode()
 	}
 
-	transcode_params := base_params
-	transcode_params.Set(PARAM_MODE, MODE_TRANSCODE)
-	transcode_url := "?" + transcode_params.Encode()
-
-	raw_params := base_params
-	raw_params.Set(PARAM_MODE, MODE_RAW)
-	raw_url := "?" + raw_params.Encode()
-
-	var v *videoData
-	if transcode {
-		v = &videoData{Url: transcode_url, DownloadUrl: raw_url,
-			TranscodeUrl: transcode_url, Type: t}
-	} else {
-		v = &videoData{Url: raw_url, DownloadUrl: raw_url, Type: t}
+	v := &videoData{Url: modeUrl(d.Mode()), DownloadUrl: modeUrl(MODE_RAW),
+		Poster: "?" + PARAM_MODE + "=" + MODE_THUMBNAIL + "&" + PARAM_WIDTH +
+			"=1280",
+		Type: d.SourceType(), Seek: r.FormValue(PARAM_SEEK),
+		Profile:  r.FormValue(PARAM_PROFILE),
+		NeedCaps: *transcode && !ClientCapabilities(r).Reported(),
+		Autoplay: len(r.FormValue(PARAM_AUTOPLAY)) > 0}
+	if *transcode {
+		v.Profiles = ProfileNames()
+	}
+	if d.Method != DirectPlay {
+		v.TranscodeUrl = v.Url
+	}
+	v.ProgressUrl = "?" + PARAM_MODE + "=" + MODE_PROGRESS
+	v.Direct = d.Method == DirectPlay
+	if !v.Direct {
+		v.Offset, _ = parseSeek(v.Seek)
+	}
+	ensureViewer(w, r)
+	if resume := viewerProgress(r, f.PathPrefix+r.URL.Path).Resume(); resume > 0 && len(v.Seek) == 0 {
+		v.Resume = resume
+		v.ResumeLabel = formatPosition(resume)
+		if !v.Direct {
+			// Transcodes can't seek far ahead, so start a new one there.
+			params := url.Values{}
+			for _, param := range []string{PARAM_PROFILE, PARAM_AUDIO} {
+				if len(r.FormValue(param)) > 0 {
+					params.Set(param, r.FormValue(param))
+				}
+			}
+			params.Set(PARAM_SEEK, strconv.Itoa(int(resume)))
+			v.ResumeUrl = "?" + params.Encode()
+		}
+	}
+	if videoPath, err := f.localPath(r); err == nil {
+		// Only streams from the transcoder start at the seek position.
+		seek := ""
+		if d.Method != DirectPlay {
+			seek = v.Seek
+		}
+		v.Subtitles = f.SubtitleTracks(videoPath, seek)
+		if info, err := Probe(videoPath); err == nil {
+			if len(info.All("audio")) > 1 {
+				v.AudioTracks = AudioTracks(info, ChooseAudio(r, info))
+			}
+			offset, _ := parseSeek(seek)
+			v.Duration = info.Duration - offset
+			v.Total = info.Duration
+		}
+		v.folderQueue = f.queueFor(r, videoPath)
+		if TrickplayReady(videoPath) {
+			v.Trickplay = "?" + PARAM_MODE + "=" + MODE_TRICKPLAY
+			if len(seek) > 0 {
+				v.Trickplay += "&" + PARAM_SEEK + "=" + url.QueryEscape(seek)
+			}
+		} else {
+			StartTrickplay(videoPath)
+		}
 	}
 	videoTemplate.Execute(w, v)
 }
@@ -341,8 +625,8 @@ func logRequest(req *http.Request) {
 	var form = ""
 	if req.Method == "POST" {
 		req.ParseForm()
-		form = " Form: " + fmt.Sprintf("%v", req.Form)
+		form = " Form: " + fmt.Sprintf("%v", Redact(req.Form))
 	}
-	log.Printf("Request: %v %v %v %v%v %v", req.Method, req.Host, req.URL,
+	log.Printf("Request: %v %v %v %v%v %v", req.Method, req.Host, RedactedUrl(req.URL),
 		req.Proto, form, "From "+req.RemoteAddr)
 }
@@ -0,0 +1,489 @@
+package staticcontent
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"github.com/EricBurnett/WebCmd/resources"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var share_file = flag.String("share_file", stateFile("shares.json"),
+	"File share links (and the key signing them) are kept in between runs. "+
+		"It's ignored unless private to the user running WebCmd.")
+
+var (
+	// Mints a share link for the file or directory it's POSTed to, valid for
+	// PARAM_EXPIRES and optionally protected by PARAM_PASSWORD.
+	MODE_SHARE = "share"
+
+	// The signed token of a share link.
+	PARAM_SHARE    = "sc_share"
+	PARAM_EXPIRES  = "sc_expires"
+	PARAM_PASSWORD = "sc_password"
+
+	// How long share links are valid for if not specified.
+	DEFAULT_SHARE_EXPIRY = 24 * time.Hour
+
+	// Where shares are listed and revoked.
+	SHARES_PATH = "/shares"
+)
+
+// Modes a share link grants, beyond plain viewing: those needed to play,
+// preview and download the shared files.
+var shareModes = map[string]bool{
+	"": true, MODE_RAW: true, MODE_TRANSCODE: true, MODE_REMUX: true,
+	MODE_SUBTITLES: true, MODE_THUMBNAIL: true, MODE_TRICKPLAY: true,
+	MODE_SPRITE: true, MODE_JSON: true, MODE_ZIP: true, MODE_TAR: true,
+	MODE_PLAY: true, MODE_M3U: true, MODE_XSPF: true, MODE_PROGRESS: true,
+}
+
+// A link granting access to one file or directory, without --static_auth's
+// credentials, until it expires or is revoked.
+type Share struct {
+	Id       string
+	Path     string // URL path of the shared file or directory
+	IsDir    bool
+	Created  time.Time
+	Expires  time.Time
+	Password string `json:",omitempty"` // Signed hash, if a password is needed
+	Playlist bool   `json:",omitempty"` // Whether it was made for playlists
+}
+
+// Whether the share has expired.
+func (s *Share) Expired() bool {
+	return time.Now().After(s.Expires)
+}
+
+// Whether the share grants access to the URL path p.
+func (s *Share) Covers(p string) bool {
+	return p == s.Path || (s.IsDir && strings.HasPrefix(p, s.Path+"/"))
+}
+
+// Whether the share needs a password.
+func (s *Share) Protected() bool {
+	return len(s.Password) > 0
+}
+
+// The shared path, as used in links.
+func (s *Share) Url() string {
+	u := (&url.URL{Path: s.Path}).EscapedPath()
+	if s.IsDir {
+		u += "/"
+	}
+	return u
+}
+
+// All shares, persisted in --share_file.
+type shareStore struct {
+	lock   sync.Mutex
+	Secret string // Hex key signing links and cookies
+	Shares map[string]*Share
+}
+
+var shares = &shareStore{}
+
+// Matches the password in a "files share" command, quoted or not.
+var commandPassword = regexp.MustCompile(`--password=("[^"]*"?|\S*)`)
+
+// Returns a copy of values that's safe to log: share tokens, and share
+// passwords as PARAM_PASSWORD or in a command's --password=, are blanked out.
+func Redact(values url.Values) url.Values {
+	redacted := url.Values{}
+	for key, vs := range values {
+		for _, v := range vs {
+			if key == PARAM_PASSWORD || key == PARAM_SHARE {
+				v = "REDACTED"
+			}
+			redacted.Add(key, commandPassword.ReplaceAllString(v, "--password=REDACTED"))
+		}
+	}
+	return redacted
+}
+
+// Returns u as a string that's safe to log, with its query Redacted.
+func RedactedUrl(u *url.URL) string {
+	if len(u.RawQuery) == 0 {
+		return u.String()
+	}
+	redacted := *u
+	redacted.RawQuery = Redact(u.Query()).Encode()
+	return redacted.String()
+}
+
+// Loads the shares from --share_file, if not yet loaded, generating a new key
+// if there isn't one. Must be called with the lock held.
+func (s *shareStore) load() {
+	if s.Shares != nil {
+		return
+	}
+	if file, err := openPrivate(*share_file); err == nil {
+		if err := json.NewDecoder(file).Decode(s); err != nil {
+			log.Println("Ignoring unreadable share file", *share_file+":", err)
+		}
+		file.Close()
+	} else if !os.IsNotExist(err) {
+		log.Println("Ignoring share file", *share_file+":", err)
+	}
+	if s.Shares == nil {
+		s.Shares = make(map[string]*Share)
+	}
+	if len(s.Secret) == 0 {
+		s.Secret = randomHex(32)
+		s.save()
+	}
+}
+
+// Writes the shares to --share_file. Must be called with the lock held.
+func (s *shareStore) save() {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err == nil {
+		err = writePrivate(*share_file, func(w io.Writer) error {
+			_, err := w.Write(data)
+			return err
+		})
+	}
+	if err != nil {
+		log.Println("Failed to save shares to", *share_file+":", err)
+	}
+}
+
+// Returns the hex signature of parts. Must be called with the lock held.
+func (s *shareStore) sign(parts ...string) string {
+	mac := hmac.New(sha256.New, []byte(s.Secret))
+	mac.Write([]byte(strings.Join(parts, "\x00")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// The token in the share's link. Must be called with the lock held.
+func (s *shareStore) token(share *Share) string {
+	return share.Id + "." + s.sign("link", share.Id, share.Path,
+		share.Expires.UTC().Format(time.RFC3339))
+}
+
+// The cookie value showing the share's password was given. Must be called
+// with the lock held.
+func (s *shareStore) unlocked(share *Share) string {
+	return share.Id + "." + s.sign("unlocked", share.Id, share.Password)
+}
+
+// Returns the live share whose token (from sign) is value, if any.
+func (s *shareStore) find(value string, sign func(*Share) string) *Share {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.load()
+	share, ok := s.Shares[strings.SplitN(value, ".", 2)[0]]
+	if !ok || share.Expired() || !hmac.Equal([]byte(value), []byte(sign(share))) {
+		return nil
+	}
+	return share
+}
+
+// Returns n random bytes, hex encoded.
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Shares the file or directory at urlPath for the given time, returning its
+// link (a URL path with query). If password is set, it's needed to open it.
+func (server *Server) Share(urlPath string, expires time.Duration, password string) (string, error) {
+	if expires <= 0 {
+		return "", errors.New("Shares must expire.")
+	}
+	urlPath = path.Clean("/" + urlPath)
+	_, p, err := server.resolve(urlPath)
+	if err != nil {
+		return "", err
+	}
+	stat, err := os.Stat(p)
+	if err != nil {
+		return "", errors.New("No such file: " + urlPath)
+	}
+	shares.lock.Lock()
+	defer shares.lock.Unlock()
+	shares.load()
+	share := &Share{Id: randomHex(8), Path: urlPath, IsDir: stat.IsDir(),
+		Created: time.Now(), Expires: time.Now().Add(expires)}
+	if len(password) > 0 {
+		share.Password = shares.sign("password", share.Id, password)
+	}
+	shares.Shares[share.Id] = share
+	shares.save()
+	log.Println("Shared", urlPath, "until", share.Expires)
+	return share.Url() + "?" + PARAM_SHARE + "=" + shares.token(share), nil
+}
+
+// Returns a share link token for playlists of the directory at urlPath, valid
+// for at most expires. Players fetch playlists again and again, so an earlier
+// playlist share of the directory is reused while it's still good for at
+// least half that long; only then is a new one made.
+func (server *Server) PlaylistToken(urlPath string, expires time.Duration) (string, error) {
+	if expires <= 0 {
+		return "", errors.New("Shares must expire.")
+	}
+	urlPath = path.Clean("/" + urlPath)
+	shares.lock.Lock()
+	defer shares.lock.Unlock()
+	shares.load()
+	now := time.Now()
+	for _, share := range shares.Shares {
+		if share.Playlist && share.Path == urlPath && !share.Protected() &&
+			!share.Expires.Before(now.Add(expires/2)) && !share.Expires.After(now.Add(expires)) {
+			return shares.token(share), nil
+		}
+	}
+	share := &Share{Id: randomHex(8), Path: urlPath, IsDir: true, Created: now,
+		Expires: now.Add(expires), Playlist: true}
+	shares.Shares[share.Id] = share
+	shares.save()
+	log.Println("Shared", urlPath, "for playlists until", share.Expires)
+	return shares.token(share), nil
+}
+
+// Returns the live shares, soonest to expire first. Expired shares are
+// dropped.
+func (server *Server) Shares() []Share {
+	shares.lock.Lock()
+	defer shares.lock.Unlock()
+	shares.load()
+	result := []Share{}
+	dropped := false
+	for id, share := range shares.Shares {
+		if share.Expired() {
+			delete(shares.Shares, id)
+			dropped = true
+			continue
+		}
+		result = append(result, *share)
+	}
+	if dropped {
+		shares.save()
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Expires.Before(result[j].Expires) })
+	return result
+}
+
+// Revokes the share with the given id.
+func (server *Server) Unshare(id string) error {
+	shares.lock.Lock()
+	defer shares.lock.Unlock()
+	shares.load()
+	share, ok := shares.Shares[id]
+	if !ok {
+		return errors.New("No such share: " + id)
+	}
+	delete(shares.Shares, id)
+	shares.save()
+	log.Println("Revoked share of", share.Path)
+	return nil
+}
+
+var SHARE_PASSWORD_TEMPLATE_FILE = "templates/share_password.html.template"
+
+type sharePasswordData struct {
+	Name  string
+	Wrong bool
+}
+
+// Wraps h, the handler of a root, so that requests need --static_auth's
+// credentials or a share covering the requested path. The share's token only
+// needs to be in the first request; a cookie scoped to the shared path
+// carries it to the player, transcodes and (for directories) everything
+// within.
+func (server *Server) guard(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if authorized(r) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		p := path.Clean("/" + r.URL.Path)
+		if shareModes[r.URL.Query().Get(PARAM_MODE)] {
+			if cookie, err := r.Cookie(PARAM_SHARE); err == nil {
+				if share := shares.find(cookie.Value, shares.unlocked); share != nil && server.shareCovers(share, p) {
+					h.ServeHTTP(w, r)
+					return
+				}
+			}
+			if token := r.URL.Query().Get(PARAM_SHARE); len(token) > 0 {
+				if share := shares.find(token, shares.token); share != nil && server.shareCovers(share, p) {
+					server.openShare(w, r, share, h)
+					return
+				}
+			}
+		}
+		w.Header().Set("WWW-Authenticate", `Basic realm="WebCmd"`)
+		http.Error(w, "Unauthorized.", http.StatusUnauthorized)
+	})
+}
+
+// Whether r may view the URL path p: it has --static_auth's credentials, or
+// an opened share covering p.
+func (f *FileHandler) canView(r *http.Request, p string) bool {
+	if authorized(r) {
+		return true
+	}
+	share := openedShare(r)
+	return share != nil && f.server.shareCovers(share, path.Clean(p))
+}
+
+// Whether the share covers the URL path p, both as named and once symlinks
+// are resolved, so that a link inside a shared folder can't reach the rest of
+// its root.
+func (server *Server) shareCovers(share *Share, p string) bool {
+	if !share.Covers(p) {
+		return false
+	}
+	_, shared, err := server.resolve(share.Path)
+	if err != nil {
+		return false
+	}
+	_, target, err := server.resolve(p)
+	if err != nil {
+		return false
+	}
+	if shared, err = filepath.EvalSymlinks(shared); err != nil {
+		return false
+	}
+	if target, err = filepath.EvalSymlinks(target); err != nil {
+		return false
+	}
+	return target == shared || (share.IsDir && within(target, shared))
+}
+
+// Returns the share r's visitor has opened, if any.
+func openedShare(r *http.Request) *Share {
+	cookie, err := r.Cookie(PARAM_SHARE)
+	if err != nil {
+		return nil
+	}
+	return shares.find(cookie.Value, shares.unlocked)
+}
+
+// Returns the share r was let in with, if any: the one it has opened, or for
+// the first request of a share link, the one its token names.
+func visitorShare(r *http.Request) *Share {
+	if share := openedShare(r); share != nil {
+		return share
+	}
+	return shares.find(r.URL.Query().Get(PARAM_SHARE), shares.token)
+}
+
+// Serves the first request of a share link: asks for the password if needed,
+// then sets the cookie granting access and serves the request with h.
+func (server *Server) openShare(w http.ResponseWriter, r *http.Request, share *Share, h http.Handler) {
+	if share.Protected() {
+		password := ""
+		if r.Method == "POST" {
+			password = r.PostFormValue(PARAM_PASSWORD)
+		}
+		shares.lock.Lock()
+		ok := hmac.Equal([]byte(shares.sign("password", share.Id, password)), []byte(share.Password))
+		shares.lock.Unlock()
+		if !ok {
+			server.servePasswordForm(w, share, len(password) > 0)
+			return
+		}
+	}
+	shares.lock.Lock()
+	value := shares.unlocked(share)
+	shares.lock.Unlock()
+	cookiePath := share.Url()
+	http.SetCookie(w, &http.Cookie{Name: PARAM_SHARE, Value: value, Path: cookiePath,
+		Expires: share.Expires, HttpOnly: true})
+	if r.Method == "POST" {
+		// The password form; show the share itself.
+		http.Redirect(w, r, r.URL.String(), http.StatusSeeOther)
+		return
+	}
+	h.ServeHTTP(w, r)
+}
+
+// Serves the form asking for a share's password.
+func (server *Server) servePasswordForm(w http.ResponseWriter, share *Share, wrong bool) {
+	template_content, err := resources.Load(SHARE_PASSWORD_TEMPLATE_FILE)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var passwordTemplate = template.New("Share password template")
+	passwordTemplate, err = passwordTemplate.Parse(string(template_content))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusUnauthorized)
+	passwordTemplate.Execute(w, &sharePasswordData{Name: path.Base(share.Path), Wrong: wrong})
+}
+
+// Handler minting a share link for the requested file or directory. Responds
+// with the link as JSON.
+func (f *FileHandler) ServeShare(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Shares must be POSTed.", http.StatusMethodNotAllowed)
+		return
+	}
+	expires := DEFAULT_SHARE_EXPIRY
+	if e := r.URL.Query().Get(PARAM_EXPIRES); len(e) > 0 {
+		var err error
+		if expires, err = time.ParseDuration(e); err != nil {
+			http.Error(w, "Invalid expiry: "+e, http.StatusBadRequest)
+			return
+		}
+	}
+	link, err := f.server.Share(f.PathPrefix+r.URL.Path, expires, r.PostFormValue(PARAM_PASSWORD))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, map[string]string{"url": link})
+}
+
+var SHARES_TEMPLATE_FILE = "templates/shares.html.template"
+
+// Serves the share-management page at SHARES_PATH, listing live shares.
+// POSTing a share's id as PARAM_ITEM revokes it.
+type sharesHandler struct {
+	server *Server
+}
+
+func (h *sharesHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	logRequest(r)
+	if r.Method == "POST" {
+		if err := h.server.Unshare(r.FormValue(PARAM_ITEM)); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		http.Redirect(w, r, SHARES_PATH, http.StatusSeeOther)
+		return
+	}
+	template_content, err := resources.Load(SHARES_TEMPLATE_FILE)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var sharesTemplate = template.New("Shares template")
+	sharesTemplate, err = sharesTemplate.Parse(string(template_content))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sharesTemplate.Execute(w, h.server.Shares())
+}
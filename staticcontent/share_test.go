@@ -0,0 +1,99 @@
+package staticcontent
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestShareTokens(t *testing.T) {
+	tests := []struct {
+		name  string
+		token func(s *shareStore, share *Share) string
+		want  bool
+	}{
+		{"link token", func(s *shareStore, share *Share) string { return s.token(share) }, true},
+		{"unlocked cookie as a link token",
+			func(s *shareStore, share *Share) string { return s.unlocked(share) }, false},
+		{"tampered signature",
+			func(s *shareStore, share *Share) string { return s.token(share) + "0" }, false},
+		{"other share's id", func(s *shareStore, share *Share) string {
+			return "other." + s.token(share)[len(share.Id)+1:]
+		}, false},
+		{"signed for another path", func(s *shareStore, share *Share) string {
+			other := *share
+			other.Path = "/r/everything"
+			return s.token(&other)
+		}, false},
+		{"signed for a later expiry", func(s *shareStore, share *Share) string {
+			other := *share
+			other.Expires = share.Expires.Add(time.Hour)
+			return s.token(&other)
+		}, false},
+		{"signed with another key", func(s *shareStore, share *Share) string {
+			return (&shareStore{Secret: "other"}).token(share)
+		}, false},
+		{"bare id", func(s *shareStore, share *Share) string { return share.Id }, false},
+		{"empty", func(s *shareStore, share *Share) string { return "" }, false},
+	}
+	for _, test := range tests {
+		s := &shareStore{Secret: "key", Shares: make(map[string]*Share)}
+		share := &Share{Id: "abc", Path: "/r/shared", IsDir: true, Expires: time.Now().Add(time.Hour)}
+		s.Shares[share.Id] = share
+		s.Shares["other"] = &Share{Id: "other", Path: "/r/shared", Expires: share.Expires}
+		if got := s.find(test.token(s, share), s.token); (got != nil) != test.want {
+			t.Errorf("find(%v) = %v; want found=%v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestShareExpiry(t *testing.T) {
+	s := &shareStore{Secret: "key", Shares: make(map[string]*Share)}
+	share := &Share{Id: "abc", Path: "/r/shared", Expires: time.Now().Add(-time.Second)}
+	s.Shares[share.Id] = share
+	if got := s.find(s.token(share), s.token); got != nil {
+		t.Errorf("find of an expired share's token = %v; want nil", got)
+	}
+	if got := s.find(s.unlocked(share), s.unlocked); got != nil {
+		t.Errorf("find of an expired share's cookie = %v; want nil", got)
+	}
+}
+
+func TestShareCovers(t *testing.T) {
+	tests := []struct {
+		share Share
+		p     string
+		want  bool
+	}{
+		{Share{Path: "/r/dir", IsDir: true}, "/r/dir", true},
+		{Share{Path: "/r/dir", IsDir: true}, "/r/dir/a/b.txt", true},
+		{Share{Path: "/r/dir", IsDir: true}, "/r/dir2/b.txt", false},
+		{Share{Path: "/r/dir", IsDir: true}, "/r", false},
+		{Share{Path: "/r/a.txt"}, "/r/a.txt", true},
+		{Share{Path: "/r/a.txt"}, "/r/a.txt/x", false},
+	}
+	for _, test := range tests {
+		if got := test.share.Covers(test.p); got != test.want {
+			t.Errorf("%+v.Covers(%q) = %v; want %v", test.share, test.p, got, test.want)
+		}
+	}
+}
+
+func TestRedact(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"sc_mode=raw", "sc_mode=raw"},
+		{"sc_password=hunter2", "sc_password=REDACTED"},
+		{"sc_share=abc.123&sc_mode=raw", "sc_mode=raw&sc_share=REDACTED"},
+		{"q=files+share+a.txt+--password%3Dhunter2", "q=files+share+a.txt+--password%3DREDACTED"},
+		{"q=files+share+a.txt+--password%3D%22two+words%22", "q=files+share+a.txt+--password%3DREDACTED"},
+	}
+	for _, test := range tests {
+		values, _ := url.ParseQuery(test.query)
+		if got := Redact(values).Encode(); got != test.want {
+			t.Errorf("Redact(%q) = %q; want %q", test.query, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package staticcontent
+
+import (
+	"errors"
+	"github.com/EricBurnett/WebCmd/platform"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+var errNotPrivate = errors.New("Owned or writable by another user.")
+
+// Returns the default path of a file kept between runs: name in a webcmd
+// directory under the user's config directory, or in the system temp
+// directory if there's none.
+func stateFile(name string) string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return filepath.Join(os.TempDir(), "webcmd_"+name)
+	}
+	return filepath.Join(dir, "webcmd", name)
+}
+
+// Opens the state file p for reading, refusing it unless it's private to the
+// current user, so no one else can plant or change what's in it.
+func openPrivate(p string) (*os.File, error) {
+	file, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := file.Stat()
+	if err == nil && !platform.PrivateFile(stat) {
+		err = errNotPrivate
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+// Replaces the state file p with what write writes, in a new file only the
+// current user can read, creating its directory if needed.
+func writePrivate(p string, write func(io.Writer) error) error {
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return err
+	}
+	tmp := p + ".tmp"
+	os.Remove(tmp)
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	err = write(file)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, p)
+}
@@ -0,0 +1,45 @@
+package staticcontent
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestStateFiles(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "webcmd", "state.json")
+	err := writePrivate(p, func(w io.Writer) error {
+		_, err := io.WriteString(w, "saved")
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := openPrivate(p)
+	if err != nil {
+		t.Fatal("openPrivate of a just written file:", err)
+	}
+	data, _ := ioutil.ReadAll(file)
+	file.Close()
+	if string(data) != "saved" {
+		t.Errorf("Read %q; want \"saved\"", data)
+	}
+	if runtime.GOOS == "windows" {
+		return // Privacy is down to ACLs.
+	}
+	if stat, err := os.Stat(p); err != nil || stat.Mode().Perm() != 0600 {
+		t.Errorf("Saved with %v, %v; want mode 0600", stat, err)
+	}
+
+	// Files others could have changed are refused.
+	if err := os.Chmod(p, 0666); err != nil {
+		t.Fatal(err)
+	}
+	if file, err := openPrivate(p); err == nil {
+		file.Close()
+		t.Errorf("openPrivate of a world-writable file succeeded")
+	}
+}
@@ -0,0 +1,232 @@
+package staticcontent
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/EricBurnett/WebCmd/platform"
+	"log"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+var (
+	MODE_SUBTITLES = "subs"
+
+	// Which subtitle track to serve: "file:<sidecar name>" for a subtitle
+	// file next to the video, or "stream:<index>" for an embedded stream.
+	PARAM_TRACK = "sc_track"
+)
+
+// Extensions of sidecar subtitle files we can convert to WebVTT.
+var subtitleExtensions = map[string]bool{
+	".srt": true, ".ass": true, ".ssa": true, ".vtt": true,
+}
+
+// Embedded subtitle codecs we can convert to WebVTT. Image-based subtitles
+// (PGS, VobSub) can't be.
+var textSubtitleCodecs = map[string]bool{
+	"subrip": true, "srt": true, "ass": true, "ssa": true, "webvtt": true,
+	"mov_text": true, "text": true,
+}
+
+// A subtitle track offered alongside a video.
+type SubtitleTrack struct {
+	Label    string
+	Language string
+	Url      string
+	Default  bool
+}
+
+// Finds the subtitle tracks available for the video at videoPath: listed
+// sidecar files named after the video (e.g. "Movie.srt" or "Movie.en.srt" for
+// "Movie.mkv"), then embedded text streams. Track URLs are relative to the
+// video's URL; if seek is set, they'll be offset to match a stream that starts
+// there.
+func (f *FileHandler) SubtitleTracks(videoPath string, seek string) []SubtitleTrack {
+	tracks := []SubtitleTrack{}
+	trackUrl := func(track string) string {
+		params := url.Values{}
+		params.Set(PARAM_MODE, MODE_SUBTITLES)
+		params.Set(PARAM_TRACK, track)
+		if len(seek) > 0 {
+			params.Set(PARAM_SEEK, seek)
+		}
+		return "?" + params.Encode()
+	}
+
+	dir, videoName := filepath.Split(videoPath)
+	base := strings.TrimSuffix(videoName, filepath.Ext(videoName))
+	if files, err := f.listDir(dir); err == nil {
+		for _, file := range files {
+			name := file.Name()
+			ext := strings.ToLower(filepath.Ext(name))
+			if file.IsDir() || !subtitleExtensions[ext] ||
+				!strings.HasPrefix(name, base+".") {
+				continue
+			}
+			// Anything between the video name and the extension is taken as
+			// the language, e.g. "en" in "Movie.en.srt".
+			language := strings.TrimSuffix(strings.TrimPrefix(name, base+"."), ext)
+			label := name
+			if len(language) > 0 {
+				label = language + " (" + name + ")"
+			}
+			tracks = append(tracks, SubtitleTrack{Label: label,
+				Language: language, Url: trackUrl("file:" + name)})
+		}
+	}
+
+	if info, err := Probe(videoPath); err == nil {
+		for _, s := range info.All("subtitle") {
+			if !textSubtitleCodecs[s.CodecName] {
+				continue
+			}
+			label := s.Title
+			if len(label) == 0 {
+				label = s.Language
+			}
+			if len(label) == 0 {
+				label = fmt.Sprintf("Track %v", s.Index)
+			}
+			tracks = append(tracks, SubtitleTrack{Label: label,
+				Language: s.Language, Default: s.Default,
+				Url: trackUrl(fmt.Sprintf("stream:%v", s.Index))})
+		}
+	}
+	return tracks
+}
+
+// Handler for serving a video's subtitle track (chosen by sc_track) as WebVTT,
+// converted by the transcoder. If sc_seek is set, cue times are shifted so
+// that the seek position becomes time zero, matching a seeked transcode.
+func (f *FileHandler) ServeSubtitles(w http.ResponseWriter, r *http.Request) {
+	videoPath, err := f.localPath(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	var args []string
+	track := r.FormValue(PARAM_TRACK)
+	switch {
+	case strings.HasPrefix(track, "file:"):
+		name := strings.TrimPrefix(track, "file:")
+		if name != filepath.Base(name) ||
+			!subtitleExtensions[strings.ToLower(filepath.Ext(name))] {
+			http.Error(w, "Invalid subtitle file.", http.StatusBadRequest)
+			return
+		}
+		subsPath, err := f.osPath(path.Join(path.Dir(r.URL.Path), name))
+		if err != nil {
+			http.Error(w, "Invalid subtitle file.", http.StatusBadRequest)
+			return
+		}
+		args = []string{*transcode_input_flag, subsPath}
+	case strings.HasPrefix(track, "stream:"):
+		index, err := strconv.Atoi(strings.TrimPrefix(track, "stream:"))
+		if err != nil {
+			http.Error(w, "Invalid subtitle stream.", http.StatusBadRequest)
+			return
+		}
+		args = []string{*transcode_input_flag, videoPath,
+			"-map", fmt.Sprintf("0:%v", index)}
+	default:
+		http.Error(w, "Invalid subtitle track.", http.StatusBadRequest)
+		return
+	}
+	args = append(args, "-f", "webvtt", "-")
+
+	cmd := exec.Command(*transcoder, args...)
+	platform.Hide(cmd)
+	log.Println("Calling", cmd.Path, cmd.Args)
+	vtt, err := cmd.Output()
+	if err != nil {
+		log.Println("Error converting subtitles:", err)
+		http.Error(w, "Unable to convert subtitles.", http.StatusInternalServerError)
+		return
+	}
+
+	if offset, err := parseSeek(r.FormValue(PARAM_SEEK)); err == nil && offset > 0 {
+		vtt = shiftVtt(vtt, offset)
+	}
+	w.Header().Set("Content-Type", "text/vtt; charset=utf-8")
+	w.Write(vtt)
+}
+
+// Parses a seek position as accepted by the transcoder ("90", "1:30" or
+// "00:01:30.5") into seconds.
+func parseSeek(seek string) (float64, error) {
+	if len(seek) == 0 {
+		return 0, errors.New("No seek position.")
+	}
+	seconds := 0.0
+	for _, part := range strings.Split(seek, ":") {
+		n, err := strconv.ParseFloat(part, 64)
+		if err != nil {
+			return 0, err
+		}
+		seconds = seconds*60 + n
+	}
+	return seconds, nil
+}
+
+// Parses a WebVTT timestamp ("01:02.345" or "01:02:03.456") into seconds.
+func parseVttTime(t string) (float64, error) {
+	return parseSeek(strings.TrimSpace(t))
+}
+
+// Formats seconds as a WebVTT timestamp.
+func formatVttTime(seconds float64) string {
+	millis := int64(seconds*1000 + 0.5)
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", millis/3600000,
+		millis/60000%60, millis/1000%60, millis%1000)
+}
+
+// Shifts every cue in a WebVTT document earlier by offset seconds. Cues that
+// would end before zero are dropped; ones that straddle it are clipped.
+func shiftVtt(vtt []byte, offset float64) []byte {
+	vtt = bytes.Replace(vtt, []byte("\r\n"), []byte("\n"), -1)
+	blocks := strings.Split(string(vtt), "\n\n")
+	out := []string{}
+	for _, block := range blocks {
+		lines := strings.Split(block, "\n")
+		keep := true
+		for i, line := range lines {
+			arrow := strings.Index(line, "-->")
+			if arrow < 0 {
+				continue
+			}
+			// "start --> end [cue settings]"
+			rest := strings.Fields(line[arrow+3:])
+			if len(rest) == 0 {
+				break
+			}
+			start, err1 := parseVttTime(line[:arrow])
+			end, err2 := parseVttTime(rest[0])
+			if err1 != nil || err2 != nil {
+				break
+			}
+			start, end = start-offset, end-offset
+			if end <= 0 {
+				keep = false
+				break
+			}
+			if start < 0 {
+				start = 0
+			}
+			lines[i] = strings.Join(append([]string{formatVttTime(start), "-->",
+				formatVttTime(end)}, rest[1:]...), " ")
+			break
+		}
+		if keep {
+			out = append(out, strings.Join(lines, "\n"))
+		}
+	}
+	return []byte(strings.Join(out, "\n\n"))
+}
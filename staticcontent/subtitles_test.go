@@ -0,0 +1,44 @@
+package staticcontent
+
+import (
+	"testing"
+)
+
+func TestShiftVtt(t *testing.T) {
+	tests := []struct {
+		offset float64
+		vtt    string
+		want   string
+	}{
+		{0, "WEBVTT\n\n00:00:05.000 --> 00:00:08.000\nHello",
+			"WEBVTT\n\n00:00:05.000 --> 00:00:08.000\nHello"},
+		{2.5, "WEBVTT\n\n00:00:05.000 --> 00:00:08.000\nHello",
+			"WEBVTT\n\n00:00:02.500 --> 00:00:05.500\nHello"},
+
+		// Cues over before the offset are dropped; ones running over it are
+		// clipped to start at zero.
+		{10, "WEBVTT\n\n00:00:05.000 --> 00:00:08.000\nGone\n\n00:00:09.000 --> 00:00:12.500\nClipped",
+			"WEBVTT\n\n00:00:00.000 --> 00:00:02.500\nClipped"},
+		{10, "WEBVTT\n\n00:00:07.000 --> 00:00:10.000\nEnds right at it",
+			"WEBVTT"},
+
+		// Cue identifiers, settings and short timestamps survive.
+		{60, "WEBVTT\n\nintro\n01:30.000 --> 01:32.000 align:start line:0\nHi",
+			"WEBVTT\n\nintro\n00:00:30.000 --> 00:00:32.000 align:start line:0\nHi"},
+		{3600, "WEBVTT\n\n01:02:03.456 --> 01:02:04.000\nLate",
+			"WEBVTT\n\n00:02:03.456 --> 00:02:04.000\nLate"},
+
+		// Windows line endings are normalized.
+		{1, "WEBVTT\r\n\r\n00:00:05.000 --> 00:00:08.000\r\nHello\r\n",
+			"WEBVTT\n\n00:00:04.000 --> 00:00:07.000\nHello\n"},
+
+		// Notes and malformed timings are left alone.
+		{1, "WEBVTT\n\nNOTE made by hand\n\nnonsense --> 00:00:02.000\nOdd",
+			"WEBVTT\n\nNOTE made by hand\n\nnonsense --> 00:00:02.000\nOdd"},
+	}
+	for _, test := range tests {
+		if got := string(shiftVtt([]byte(test.vtt), test.offset)); got != test.want {
+			t.Errorf("shiftVtt(%q, %v) = %q; want %q", test.vtt, test.offset, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,299 @@
+package staticcontent
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"flag"
+	"github.com/EricBurnett/WebCmd/platform"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+var text_index = flag.Bool("text_index", false,
+	"Index the contents of text-like files in static content roots for "+
+		"\"files find-text\".")
+var text_index_file = flag.String("text_index_file",
+	stateFile("text_index.gob"),
+	"Where to store the full-text index between runs. It's ignored unless "+
+		"private to the user running WebCmd.")
+var pdf_extractor = flag.String("pdf_extractor", "pdftotext",
+	"Program to extract text from PDFs for the full-text index, taking "+
+		"pdftotext arguments. If set to '', PDFs aren't indexed.")
+var max_text_size = flag.Int64("max_text_size", 10<<20,
+	"Largest file (in bytes) to index the contents of.")
+
+var (
+	// Lines of context shown around each match.
+	TEXT_CONTEXT_LINES = 2
+	// Most matches shown per file.
+	MAX_TEXT_MATCHES_PER_FILE = 5
+)
+
+// Extensions of files whose contents are indexed as plain text.
+var textExtensions = map[string]bool{
+	"txt": true, "md": true, "csv": true, "tsv": true, "html": true,
+	"htm": true, "xml": true, "json": true, "yaml": true, "yml": true,
+	"ini": true, "cfg": true, "conf": true, "log": true, "tex": true,
+	"go": true, "c": true, "h": true, "cc": true, "cpp": true, "hpp": true,
+	"java": true, "py": true, "rb": true, "rs": true, "js": true, "ts": true,
+	"css": true, "sh": true, "bat": true, "sql": true, "php": true,
+}
+
+var errTextIndexDisabled = errors.New("Full-text search is disabled; set " +
+	"--text_index to enable it.")
+
+// A document in the full-text index.
+type textDoc struct {
+	Root    string // URL path of the root it's in
+	RelPath string // Slash-separated path within the root
+	ModTime time.Time
+	Size    int64
+	Words   []string // Distinct lowercase words in the document
+}
+
+// An on-disk, incrementally rebuilt index from words to the text-like files
+// containing them. Matching lines are found by re-reading the candidate files
+// at search time.
+type TextIndex struct {
+	lock  sync.RWMutex
+	docs  map[string]*textDoc        // OS path -> document
+	words map[string]map[string]bool // word -> OS paths containing it
+}
+
+// A line of a file shown in full-text search results.
+type TextLine struct {
+	Number int
+	Text   string
+	Match  bool // Whether this line matched, rather than being context
+}
+
+// A file matching a full-text search, with its matching lines in context.
+type TextMatch struct {
+	Name  string
+	Url   string
+	Path  string
+	Lines [][]TextLine // Groups of consecutive lines around matches
+}
+
+// Whether name is a file whose contents we can index.
+func isTextIndexable(name string) bool {
+	ext := extension(name)
+	return textExtensions[ext] || ext == "pdf" && len(*pdf_extractor) > 0
+}
+
+// Splits text into lowercase words.
+func words(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// Returns the text content of the file at p, extracting it from PDFs.
+func readText(p string) ([]byte, error) {
+	if extension(p) == "pdf" {
+		cmd := exec.Command(*pdf_extractor, "-q", "-enc", "UTF-8", p, "-")
+		platform.Hide(cmd)
+		return cmd.Output()
+	}
+	return ioutil.ReadFile(p)
+}
+
+// Loads the index saved at --text_index_file, or returns an empty one if it
+// can't be read.
+func LoadTextIndex() *TextIndex {
+	t := &TextIndex{docs: make(map[string]*textDoc)}
+	if file, err := openPrivate(*text_index_file); err == nil {
+		if err := gob.NewDecoder(file).Decode(&t.docs); err != nil {
+			log.Println("Unable to read text index; rebuilding:", err)
+			t.docs = make(map[string]*textDoc)
+		}
+		file.Close()
+	} else if !os.IsNotExist(err) {
+		log.Println("Unable to read text index; rebuilding:", err)
+	}
+	t.rebuildWords()
+	return t
+}
+
+func (t *TextIndex) rebuildWords() {
+	t.words = make(map[string]map[string]bool)
+	for p, doc := range t.docs {
+		for _, word := range doc.Words {
+			if t.words[word] == nil {
+				t.words[word] = make(map[string]bool)
+			}
+			t.words[word][p] = true
+		}
+	}
+}
+
+// Brings the index up to date with the directories found by the name index,
+// re-reading only files that changed, then saves it.
+func (t *TextIndex) Update(dirs map[string]*indexedDir) {
+	t.lock.RLock()
+	old := t.docs
+	t.lock.RUnlock()
+
+	docs := make(map[string]*textDoc)
+	changed := 0
+	for dirPath, d := range dirs {
+		for _, e := range d.entries {
+			if e.IsDir || e.Size > *max_text_size || !isTextIndexable(e.Name) {
+				continue
+			}
+			p := filepath.Join(dirPath, e.Name)
+			if doc, has := old[p]; has && doc.ModTime.Equal(e.ModTime) &&
+				doc.Size == e.Size {
+				docs[p] = doc
+				continue
+			}
+			content, err := readText(p)
+			if err != nil {
+				log.Println("Unable to index contents of", p, ":", err)
+				continue
+			}
+			distinct := make(map[string]bool)
+			for _, word := range words(string(content)) {
+				distinct[word] = true
+			}
+			doc := &textDoc{Root: e.Root, RelPath: e.RelPath,
+				ModTime: e.ModTime, Size: e.Size}
+			for word := range distinct {
+				doc.Words = append(doc.Words, word)
+			}
+			docs[p] = doc
+			changed++
+		}
+	}
+	if changed == 0 && len(docs) == len(old) {
+		return
+	}
+
+	t.lock.Lock()
+	t.docs = docs
+	t.rebuildWords()
+	t.lock.Unlock()
+	log.Println("Reindexed contents of", changed, "files;", len(docs), "in total")
+	if err := t.save(); err != nil {
+		log.Println("Unable to save text index:", err)
+	}
+}
+
+// Writes the index to --text_index_file.
+func (t *TextIndex) save() error {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	return writePrivate(*text_index_file, func(w io.Writer) error {
+		return gob.NewEncoder(w).Encode(t.docs)
+	})
+}
+
+// Finds files containing every word of query, with their matching lines.
+func (t *TextIndex) Find(query string) []TextMatch {
+	terms := words(query)
+	if len(terms) == 0 {
+		return nil
+	}
+	t.lock.RLock()
+	candidates := []string{}
+	for p := range t.words[terms[0]] {
+		all := true
+		for _, term := range terms[1:] {
+			if !t.words[term][p] {
+				all = false
+				break
+			}
+		}
+		if all {
+			candidates = append(candidates, p)
+		}
+	}
+	docs := make(map[string]textDoc)
+	for _, p := range candidates {
+		docs[p] = *t.docs[p]
+	}
+	t.lock.RUnlock()
+	sort.Strings(candidates)
+
+	matches := []TextMatch{}
+	for _, p := range candidates {
+		if len(matches) >= MAX_SEARCH_RESULTS {
+			break
+		}
+		doc := docs[p]
+		content, err := readText(p)
+		if err != nil {
+			continue
+		}
+		m := TextMatch{Name: filepath.Base(p), Path: doc.Root + doc.RelPath,
+			Url: doc.Root + escapePath(doc.RelPath), Lines: matchingLines(content, terms)}
+		if len(m.Lines) > 0 {
+			matches = append(matches, m)
+		}
+	}
+	return matches
+}
+
+// Finds the lines of content containing any of terms, and groups them with
+// TEXT_CONTEXT_LINES lines of context either side.
+func matchingLines(content []byte, terms []string) [][]TextLine {
+	lines := []string{}
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+
+	matched := make(map[int]bool)
+	hits := []int{}
+	for i, line := range lines {
+		lower := strings.ToLower(line)
+		for _, term := range terms {
+			if strings.Contains(lower, term) {
+				matched[i] = true
+				hits = append(hits, i)
+				break
+			}
+		}
+		if len(hits) >= MAX_TEXT_MATCHES_PER_FILE {
+			break
+		}
+	}
+
+	groups := [][]TextLine{}
+	next := 0 // First line not yet shown
+	for _, hit := range hits {
+		start, end := hit-TEXT_CONTEXT_LINES, hit+TEXT_CONTEXT_LINES
+		if start < 0 {
+			start = 0
+		}
+		if len(groups) > 0 && start <= next {
+			// Overlaps or adjoins the previous group; extend it.
+			start = next
+		} else {
+			groups = append(groups, []TextLine{})
+		}
+		if end >= len(lines) {
+			end = len(lines) - 1
+		}
+		g := &groups[len(groups)-1]
+		for j := start; j <= end; j++ {
+			*g = append(*g, TextLine{Number: j + 1, Text: lines[j], Match: matched[j]})
+		}
+		if end+1 > next {
+			next = end + 1
+		}
+	}
+	return groups
+}
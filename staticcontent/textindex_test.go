@@ -0,0 +1,58 @@
+package staticcontent
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// Describes groups of lines as "number:text" lists, matches starred, with
+// groups split by "|".
+func describeLines(groups [][]TextLine) string {
+	described := []string{}
+	for _, group := range groups {
+		lines := []string{}
+		for _, line := range group {
+			s := fmt.Sprintf("%v:%v", line.Number, line.Text)
+			if line.Match {
+				s += "*"
+			}
+			lines = append(lines, s)
+		}
+		described = append(described, strings.Join(lines, " "))
+	}
+	return strings.Join(described, " | ")
+}
+
+func TestMatchingLines(t *testing.T) {
+	tests := []struct {
+		content string
+		terms   []string
+		want    string
+	}{
+		{"a\nb\nc\nd\nx\nf\ng\nh", []string{"x"}, "3:c 4:d 5:x* 6:f 7:g"},
+		{"x\nb\nc\nd", []string{"x"}, "1:x* 2:b 3:c"},
+		{"a\nb\nc\nx", []string{"x"}, "2:b 3:c 4:x*"},
+		{"a\nb\nc", []string{"x"}, ""},
+
+		// Case is ignored in the text; terms arrive lowercased.
+		{"Hello World", []string{"world"}, "1:Hello World*"},
+		// Any term matches.
+		{"cat\nb\nc\nd\ne\nf\ndog", []string{"dog", "cat"}, "1:cat* 2:b 3:c | 5:e 6:f 7:dog*"},
+
+		// Overlapping and adjoining context is merged into one group.
+		{"a\nx\nc\nd\nx\nf", []string{"x"}, "1:a 2:x* 3:c 4:d 5:x* 6:f"},
+		{"a\nx\nc\nd\ne\nf\nx\nh", []string{"x"}, "1:a 2:x* 3:c 4:d 5:e 6:f 7:x* 8:h"},
+		{"a\nx\nc\nd\ne\nf\ng\nx", []string{"x"}, "1:a 2:x* 3:c 4:d | 6:f 7:g 8:x*"},
+
+		// Only the first few matches are shown.
+		{"x1\nx2\nx3\nx4\nx5\nx6\nx7", []string{"x"}, "1:x1* 2:x2* 3:x3* 4:x4* 5:x5* 6:x6 7:x7"},
+
+		{"a\r\nx\r\n", []string{"x"}, "1:a 2:x*"},
+	}
+	for _, test := range tests {
+		if got := describeLines(matchingLines([]byte(test.content), test.terms)); got != test.want {
+			t.Errorf("matchingLines(%q, %q) = %q; want %q", test.content, test.terms, got, test.want)
+		}
+	}
+}
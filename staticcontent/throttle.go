@@ -0,0 +1,239 @@
+package staticcontent
+
+import (
+	"flag"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var max_bandwidth = flag.Int64("max_bandwidth", 0,
+	"Most bytes per second static content may be sent at, in total. 0 for "+
+		"no limit.")
+var client_bandwidth = flag.Int64("client_bandwidth", 0,
+	"Most bytes per second static content may be sent to each client IP at. "+
+		"0 for no limit.")
+var bulk_share = flag.Float64("bulk_share", 0.25,
+	"While media is streaming, the share of each bandwidth limit downloads "+
+		"may use, leaving the rest for playback.")
+
+// How far ahead of schedule an idle limiter lets transfers run, so short
+// bursts go out at full speed.
+var THROTTLE_BURST = 250 * time.Millisecond
+
+// Writes are throttled in pieces of at most this many bytes.
+var THROTTLE_CHUNK = 32 << 10
+
+// A bandwidth limit shared by many transfers. Each transfer reserves time on
+// the limiter's clock for the bytes it sends; bulk transfers are also held to
+// --bulk_share of the rate while any stream is active.
+type limiter struct {
+	lock     sync.Mutex
+	rate     int64     // Bytes per second; 0 for no limit
+	next     time.Time // When all bytes reserved so far will have been sent
+	bulkNext time.Time // The same, for bulk transfers' share
+	streams  int       // Active streams
+	users    int       // Active transfers, for dropping idle client limiters
+}
+
+// Advances clock by n bytes at rate, returning how long until they may be
+// sent.
+func advance(clock *time.Time, now time.Time, n int, rate float64) time.Duration {
+	if clock.Before(now.Add(-THROTTLE_BURST)) {
+		*clock = now.Add(-THROTTLE_BURST)
+	}
+	*clock = clock.Add(time.Duration(float64(n) / rate * float64(time.Second)))
+	return clock.Sub(now)
+}
+
+// Reserves n bytes, returning how long to wait before sending them.
+func (l *limiter) reserve(n int, bulk bool) time.Duration {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.rate <= 0 {
+		return 0
+	}
+	now := time.Now()
+	wait := advance(&l.next, now, n, float64(l.rate))
+	if bulk && l.streams > 0 && *bulk_share > 0 {
+		if bulkWait := advance(&l.bulkNext, now, n, float64(l.rate)**bulk_share); bulkWait > wait {
+			wait = bulkWait
+		}
+	}
+	return wait
+}
+
+// Counts a transfer (and whether it's a stream) as active on the limiter
+// until the returned function is called.
+func (l *limiter) start(stream bool) func() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.users++
+	if stream {
+		l.streams++
+	}
+	return func() {
+		l.lock.Lock()
+		defer l.lock.Unlock()
+		l.users--
+		if stream {
+			l.streams--
+		}
+	}
+}
+
+var globalLimiter = &limiter{}
+
+// Limiters per client IP, while they have transfers active.
+var clientLimiters = struct {
+	sync.Mutex
+	m map[string]*limiter
+}{m: make(map[string]*limiter)}
+
+// Returns the limiter for the client at addr (a host:port), counting a
+// transfer on it until the returned function is called.
+func clientLimiter(addr string, stream bool) (*limiter, func()) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	clientLimiters.Lock()
+	l, has := clientLimiters.m[host]
+	if !has {
+		l = &limiter{rate: *client_bandwidth}
+		clientLimiters.m[host] = l
+	}
+	done := l.start(stream)
+	clientLimiters.Unlock()
+	return l, func() {
+		clientLimiters.Lock()
+		defer clientLimiters.Unlock()
+		done()
+		if l.users == 0 {
+			delete(clientLimiters.m, host)
+		}
+	}
+}
+
+// A ResponseWriter sending through a set of limiters.
+type throttledWriter struct {
+	http.ResponseWriter
+	limiters []*limiter
+	bulk     bool
+}
+
+// Waits until n more bytes may be sent.
+func (t *throttledWriter) wait(n int) {
+	var wait time.Duration
+	for _, l := range t.limiters {
+		if w := l.reserve(n, t.bulk); w > wait {
+			wait = w
+		}
+	}
+	time.Sleep(wait)
+}
+
+func (t *throttledWriter) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		n := len(b)
+		if n > THROTTLE_CHUNK {
+			n = THROTTLE_CHUNK
+		}
+		t.wait(n)
+		m, err := t.ResponseWriter.Write(b[:n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// Sends what's read from src a chunk at a time, handing each chunk to the
+// underlying ResponseWriter's ReadFrom where it has one, so files are still
+// sent with sendfile.
+func (t *throttledWriter) ReadFrom(src io.Reader) (int64, error) {
+	from, ok := t.ResponseWriter.(io.ReaderFrom)
+	if !ok {
+		return io.CopyBuffer(struct{ io.Writer }{t}, src, make([]byte, THROTTLE_CHUNK))
+	}
+	var written int64
+	for {
+		t.wait(THROTTLE_CHUNK)
+		n, err := from.ReadFrom(io.LimitReader(src, int64(THROTTLE_CHUNK)))
+		written += n
+		if err != nil || n < int64(THROTTLE_CHUNK) {
+			return written, err
+		}
+	}
+}
+
+// Flushes the underlying ResponseWriter, if it can be, so streamed responses
+// like transcodes aren't held back in its buffer.
+func (t *throttledWriter) Flush() {
+	if flusher, ok := t.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Whether r is media playback: a transcode or remux, or a player fetching
+// audio or video (which browsers do with range requests).
+func isStream(r *http.Request) bool {
+	switch r.URL.Query().Get(PARAM_MODE) {
+	case MODE_TRANSCODE, MODE_REMUX:
+		return true
+	case "", MODE_RAW:
+		kind := FileKind(r.URL.Path)
+		return (kind == KIND_VIDEO || kind == KIND_AUDIO) && len(r.Header.Get("Range")) > 0
+	}
+	return false
+}
+
+// Whether r is a bulk download, yielding to streams: a file fetched whole
+// or an archive. Listings and player pages aren't.
+func isBulk(r *http.Request) bool {
+	mode := r.URL.Query().Get(PARAM_MODE)
+	switch mode {
+	case MODE_ZIP, MODE_TAR:
+		return true
+	case "", MODE_RAW:
+		if isStream(r) || strings.HasSuffix(r.URL.Path, "/") || len(r.URL.Path) == 0 {
+			return false
+		}
+		return mode == MODE_RAW || !isPlayable(r.URL.Path)
+	}
+	return false
+}
+
+// Wraps w so responses to r are held to the global, root and client
+// bandwidth limits. The returned function must be called once the response
+// is done.
+func (f *FileHandler) throttle(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, func()) {
+	if _, ok := w.(*throttledWriter); ok {
+		// Already throttled, e.g. a handler delegating to another.
+		return w, func() {}
+	}
+	if *max_bandwidth <= 0 && *client_bandwidth <= 0 && f.limiter.rate <= 0 {
+		return w, func() {}
+	}
+	globalLimiter.lock.Lock()
+	globalLimiter.rate = *max_bandwidth
+	globalLimiter.lock.Unlock()
+
+	stream := isStream(r)
+	client, clientDone := clientLimiter(r.RemoteAddr, stream)
+	globalDone := globalLimiter.start(stream)
+	rootDone := f.limiter.start(stream)
+	return &throttledWriter{ResponseWriter: w,
+			limiters: []*limiter{globalLimiter, f.limiter, client}, bulk: isBulk(r)},
+		func() {
+			clientDone()
+			globalDone()
+			rootDone()
+		}
+}
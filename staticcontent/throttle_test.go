@@ -0,0 +1,45 @@
+package staticcontent
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Records how the throttled writer hands on its bytes.
+type recordingWriter struct {
+	*httptest.ResponseRecorder
+	readFroms int
+}
+
+func (r *recordingWriter) ReadFrom(src io.Reader) (int64, error) {
+	r.readFroms++
+	return io.Copy(r.ResponseRecorder, src)
+}
+
+func TestThrottledWriterPassesThrough(t *testing.T) {
+	defer func(saved int) { THROTTLE_CHUNK = saved }(THROTTLE_CHUNK)
+	THROTTLE_CHUNK = 4
+	under := &recordingWriter{ResponseRecorder: httptest.NewRecorder()}
+	var w http.ResponseWriter = &throttledWriter{ResponseWriter: under,
+		limiters: []*limiter{{}}}
+
+	n, err := io.Copy(w, struct{ io.Reader }{strings.NewReader("0123456789")})
+	if err != nil || n != 10 || under.Body.String() != "0123456789" {
+		t.Errorf("io.Copy = %v, %v, sent %q; want all 10 bytes", n, err, under.Body.String())
+	}
+	if under.readFroms != 3 {
+		t.Errorf("Underlying ReadFrom called %v times; want once per chunk", under.readFroms)
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		t.Fatal("throttledWriter isn't an http.Flusher")
+	}
+	flusher.Flush()
+	if !under.Flushed {
+		t.Error("Flush didn't reach the underlying ResponseWriter")
+	}
+}
@@ -0,0 +1,267 @@
+package staticcontent
+
+import (
+	"crypto/sha1"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/EricBurnett/WebCmd/platform"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+var thumbnail_cache = flag.String("thumbnail_cache",
+	filepath.Join(os.TempDir(), "webcmd_thumbnails"),
+	"Directory to cache generated thumbnails in.")
+var thumbnail_width = flag.Int("thumbnail_width", 320,
+	"Default width of generated thumbnails, in pixels.")
+var thumbnail_cache_age = flag.Duration("thumbnail_cache_age", 30*24*time.Hour,
+	"How long a cached thumbnail or set of seek-bar previews may go unused "+
+		"before being purged. If 0, they're kept regardless of age.")
+var thumbnail_cache_size = flag.Int64("thumbnail_cache_size", 2<<30,
+	"Most bytes of thumbnails and seek-bar previews to keep cached; the "+
+		"least recently used are purged beyond this. If 0, there's no limit.")
+
+var (
+	MODE_THUMBNAIL = "thumb"
+
+	// Width of the thumbnail to serve, in pixels.
+	PARAM_WIDTH = "sc_width"
+
+	// Largest thumbnail width that may be requested.
+	MAX_THUMBNAIL_WIDTH = 1920
+)
+
+// Limits how many thumbnails are generated at once, since a grid listing
+// requests a whole directory's worth in one go.
+var thumbnailSlots = make(chan bool, 2)
+
+// Handler for serving a thumbnail of the requested video or image, or the
+// cover art of an audio file, at the width given by sc_width (or
+// --thumbnail_width). Thumbnails are generated on first request and cached on
+// disk until the file changes.
+func (f *FileHandler) ServeThumbnail(w http.ResponseWriter, r *http.Request) {
+	p, err := f.localPath(r)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	if IsAudio(p) && !hasEmbeddedCover(p) {
+		if p = f.folderCover(filepath.Dir(p)); len(p) == 0 {
+			http.NotFound(w, r)
+			return
+		}
+	}
+	width := *thumbnail_width
+	if requested, err := strconv.Atoi(r.FormValue(PARAM_WIDTH)); err == nil &&
+		requested > 0 && requested <= MAX_THUMBNAIL_WIDTH {
+		width = requested
+	}
+	thumbPath, err := Thumbnail(p, width)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	http.ServeFile(w, r, thumbPath)
+}
+
+// Returns the path of a cached JPEG thumbnail of the video or image at p,
+// scaled to width, generating it if needed. Audio files get the cover art
+// embedded in them.
+func Thumbnail(p string, width int) (string, error) {
+	stat, err := os.Stat(p)
+	if err != nil {
+		return "", err
+	}
+	if stat.IsDir() || (!IsVideo(p) && !IsImage(p) && !IsAudio(p)) {
+		return "", errors.New("No thumbnail available for " + p)
+	}
+	key := fmt.Sprintf("%x", sha1.Sum([]byte(fmt.Sprintf("%v|%v|%v|%v",
+		p, stat.ModTime().UnixNano(), stat.Size(), width))))
+	thumbPath := filepath.Join(*thumbnail_cache, key+".jpg")
+	if _, err := os.Stat(thumbPath); err == nil {
+		touchCached(thumbPath)
+		return thumbPath, nil
+	}
+
+	thumbnailSlots <- true
+	defer func() { <-thumbnailSlots }()
+	// Someone else may have generated it while we waited.
+	if _, err := os.Stat(thumbPath); err == nil {
+		return thumbPath, nil
+	}
+	if err := os.MkdirAll(*thumbnail_cache, 0755); err != nil {
+		return "", err
+	}
+	tmpPath := filepath.Join(*thumbnail_cache, key+".tmp.jpg")
+	if IsVideo(p) {
+		err = videoThumbnail(p, tmpPath, width)
+	} else if IsAudio(p) {
+		err = audioCover(p, tmpPath, width)
+	} else {
+		err = imageThumbnail(p, tmpPath, width)
+	}
+	if err != nil {
+		log.Println("Unable to generate thumbnail for", p, ":", err)
+		os.Remove(tmpPath)
+		return "", err
+	}
+	if err := os.Rename(tmpPath, thumbPath); err != nil {
+		return "", err
+	}
+	log.Println("Generated thumbnail for", p)
+	return thumbPath, nil
+}
+
+// Marks the cache entry at p as just used, so it's purged last.
+func touchCached(p string) {
+	now := time.Now()
+	os.Chtimes(p, now, now)
+}
+
+// Returns the bytes taken by the file or directory at p.
+func diskUsage(p string) int64 {
+	var total int64
+	filepath.Walk(p, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			total += info.Size()
+		}
+		return nil
+	})
+	return total
+}
+
+// Removes thumbnails and sprite sheets unused for --thumbnail_cache_age, then
+// the least recently used beyond --thumbnail_cache_size. Sheets still being
+// generated are left alone.
+func PurgeThumbnails() {
+	purgeCache(*thumbnail_cache, *thumbnail_cache_age, *thumbnail_cache_size,
+		func(p string) bool {
+			trickplayLock.Lock()
+			defer trickplayLock.Unlock()
+			return trickplayRunning[p]
+		})
+}
+
+// Removes the entries of the cache directory dir unused for maxAge, then the
+// least recently used beyond maxSize bytes; 0 means no limit. Entries busy
+// reports are in use are left alone.
+func purgeCache(dir string, maxAge time.Duration, maxSize int64, busy func(p string) bool) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].ModTime().After(entries[j].ModTime())
+	})
+	var total int64
+	for _, entry := range entries {
+		p := filepath.Join(dir, entry.Name())
+		if busy(p) {
+			continue
+		}
+		size := entry.Size()
+		if entry.IsDir() {
+			size = diskUsage(p)
+		}
+		total += size
+		if maxAge > 0 && time.Since(entry.ModTime()) > maxAge ||
+			maxSize > 0 && total > maxSize {
+			if err := os.RemoveAll(p); err != nil {
+				log.Println("Unable to purge cache entry:", err)
+			}
+			total -= size
+		}
+	}
+}
+
+// Extracts a frame from the video at p with the transcoder, a little way in
+// to skip past any black intro frames.
+func videoThumbnail(p string, out string, width int) error {
+	args := []string{}
+	if len(*transcode_seek_flag) > 0 {
+		at := 10.0
+		if info, err := Probe(p); err == nil && info.Duration > 0 &&
+			info.Duration/10 < at {
+			at = info.Duration / 10
+		}
+		args = append(args, *transcode_seek_flag, fmt.Sprintf("%.2f", at))
+	}
+	args = append(args, *transcode_input_flag, p, "-frames:v", "1",
+		"-vf", fmt.Sprintf("scale=%v:-2", width), "-q:v", "4", "-y", out)
+	cmd := exec.Command(*transcoder, args...)
+	platform.Hide(cmd)
+	log.Println("Calling", cmd.Path, cmd.Args)
+	return cmd.Run()
+}
+
+// Scales the image at p down to width (images are never scaled up) and
+// writes it to out as a JPEG.
+func imageThumbnail(p string, out string, width int) error {
+	in, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	src, _, err := image.Decode(in)
+	if err != nil {
+		return err
+	}
+	dst := scaleImage(src, width)
+	file, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	err = jpeg.Encode(file, dst, &jpeg.Options{Quality: 80})
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Scales src to the given width, preserving aspect ratio, by averaging the
+// source pixels that fall within each destination pixel.
+func scaleImage(src image.Image, width int) image.Image {
+	b := src.Bounds()
+	if b.Dx() <= width {
+		return src
+	}
+	height := b.Dy() * width / b.Dx()
+	if height < 1 {
+		height = 1
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0 := b.Min.Y + y*b.Dy()/height
+		y1 := b.Min.Y + (y+1)*b.Dy()/height
+		for x := 0; x < width; x++ {
+			x0 := b.Min.X + x*b.Dx()/width
+			x1 := b.Min.X + (x+1)*b.Dx()/width
+			var r, g, bl, a, n uint32
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					pr, pg, pb, pa := src.At(sx, sy).RGBA()
+					r, g, bl, a, n = r+pr, g+pg, bl+pb, a+pa, n+1
+				}
+			}
+			if n == 0 {
+				continue
+			}
+			dst.Set(x, y, color.RGBA64{uint16(r / n), uint16(g / n),
+				uint16(bl / n), uint16(a / n)})
+		}
+	}
+	return dst
+}
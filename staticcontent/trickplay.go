@@ -0,0 +1,185 @@
+package staticcontent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"flag"
+	"fmt"
+	"github.com/EricBurnett/WebCmd/platform"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+var trickplay = flag.Bool("trickplay", true,
+	"Generate seek-bar preview sprites for videos in the background when "+
+		"their player page is first opened.")
+var trickplay_interval = flag.Int("trickplay_interval", 10,
+	"Seconds between the frames of seek-bar preview sprites.")
+
+var (
+	// The WebVTT track mapping times to sprite regions.
+	MODE_TRICKPLAY = "trickplay"
+	// A single sprite sheet, chosen by PARAM_SHEET.
+	MODE_SPRITE = "sprite"
+	PARAM_SHEET = "sc_sheet"
+
+	// Layout of each sprite sheet.
+	TRICKPLAY_TILE_WIDTH = 160
+	TRICKPLAY_COLUMNS    = 10
+	TRICKPLAY_ROWS       = 10
+)
+
+// Name of the marker file written once all of a video's sheets exist.
+var trickplayDoneFile = "done"
+
+var (
+	trickplayLock    sync.Mutex
+	trickplayRunning = make(map[string]bool)
+)
+
+// Returns the directory sprite sheets for the video at p are cached in,
+// keyed on the file's identity so edits invalidate old sheets.
+func trickplayDir(p string) (string, error) {
+	stat, err := os.Stat(p)
+	if err != nil {
+		return "", err
+	}
+	key := fmt.Sprintf("%x", sha1.Sum([]byte(fmt.Sprintf("trickplay|%v|%v|%v|%v",
+		p, stat.ModTime().UnixNano(), stat.Size(), *trickplay_interval))))
+	return filepath.Join(*thumbnail_cache, key), nil
+}
+
+// Whether sprite sheets for the video at p are ready to serve.
+func TrickplayReady(p string) bool {
+	dir, err := trickplayDir(p)
+	if err != nil {
+		return false
+	}
+	if _, err = os.Stat(filepath.Join(dir, trickplayDoneFile)); err != nil {
+		return false
+	}
+	touchCached(dir)
+	return true
+}
+
+// Videos' sprite sheets are generated one at a time, each taking minutes. They
+// have their own slot so thumbnails for listings never wait behind them.
+var trickplaySlot = make(chan bool, 1)
+
+// Starts generating sprite sheets for the video at p in the background, unless
+// they already exist or are being generated.
+func StartTrickplay(p string) {
+	if !*trickplay || *trickplay_interval <= 0 || TrickplayReady(p) {
+		return
+	}
+	dir, err := trickplayDir(p)
+	if err != nil {
+		return
+	}
+	trickplayLock.Lock()
+	defer trickplayLock.Unlock()
+	if trickplayRunning[dir] {
+		return
+	}
+	trickplayRunning[dir] = true
+	go func() {
+		if err := generateTrickplay(p, dir); err != nil {
+			log.Println("Unable to generate trickplay sprites for", p, ":", err)
+		}
+		trickplayLock.Lock()
+		delete(trickplayRunning, dir)
+		trickplayLock.Unlock()
+	}()
+}
+
+// Extracts one frame every --trickplay_interval seconds from the video at p and
+// tiles them into numbered sprite sheets in dir.
+func generateTrickplay(p string, dir string) error {
+	trickplaySlot <- true
+	defer func() { <-trickplaySlot }()
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	cmd := exec.Command(*transcoder, *transcode_input_flag, p,
+		"-an", "-sn", "-vf", fmt.Sprintf("fps=1/%v,scale=%v:-2,tile=%vx%v",
+			*trickplay_interval, TRICKPLAY_TILE_WIDTH, TRICKPLAY_COLUMNS,
+			TRICKPLAY_ROWS),
+		"-q:v", "5", "-y", filepath.Join(dir, "sheet_%03d.jpg"))
+	platform.Hide(cmd)
+	log.Println("Calling", cmd.Path, cmd.Args)
+	if err := cmd.Run(); err != nil {
+		return err
+	}
+	log.Println("Generated trickplay sprites for", p)
+	return ioutil.WriteFile(filepath.Join(dir, trickplayDoneFile), nil, 0644)
+}
+
+// Handler for the WebVTT thumbnails track of the requested video: one cue per
+// frame, pointing at its region of a sprite sheet. If sc_seek is set, cue
+// times are shifted to match a stream that starts there.
+func (f *FileHandler) ServeTrickplayTrack(w http.ResponseWriter, r *http.Request) {
+	p, err := f.localPath(r)
+	if err != nil || !TrickplayReady(p) {
+		http.NotFound(w, r)
+		return
+	}
+	info, err := Probe(p)
+	video := (*Stream)(nil)
+	if err == nil {
+		video = info.First("video")
+	}
+	if video == nil || video.Width == 0 || info.Duration <= 0 {
+		http.NotFound(w, r)
+		return
+	}
+	tileHeight := video.Height * TRICKPLAY_TILE_WIDTH / video.Width
+	// Matches ffmpeg's rounding of "scale=W:-2" to an even height.
+	tileHeight += tileHeight % 2
+	perSheet := TRICKPLAY_COLUMNS * TRICKPLAY_ROWS
+
+	var vtt bytes.Buffer
+	vtt.WriteString("WEBVTT\n")
+	interval := float64(*trickplay_interval)
+	for i := 0; float64(i)*interval < info.Duration; i++ {
+		tile := i % perSheet
+		fmt.Fprintf(&vtt, "\n%v --> %v\n?%v=%v&%v=%v#xywh=%v,%v,%v,%v\n",
+			formatVttTime(float64(i)*interval), formatVttTime(float64(i+1)*interval),
+			PARAM_MODE, MODE_SPRITE, PARAM_SHEET, i/perSheet+1,
+			tile%TRICKPLAY_COLUMNS*TRICKPLAY_TILE_WIDTH,
+			tile/TRICKPLAY_COLUMNS*tileHeight, TRICKPLAY_TILE_WIDTH, tileHeight)
+	}
+
+	out := vtt.Bytes()
+	if offset, err := parseSeek(r.FormValue(PARAM_SEEK)); err == nil && offset > 0 {
+		out = shiftVtt(out, offset)
+	}
+	w.Header().Set("Content-Type", "text/vtt; charset=utf-8")
+	w.Write(out)
+}
+
+// Handler for a single sprite sheet of the requested video.
+func (f *FileHandler) ServeSprite(w http.ResponseWriter, r *http.Request) {
+	p, err := f.localPath(r)
+	if err != nil || !TrickplayReady(p) {
+		http.NotFound(w, r)
+		return
+	}
+	sheet, err := strconv.Atoi(r.FormValue(PARAM_SHEET))
+	if err != nil || sheet < 1 {
+		http.NotFound(w, r)
+		return
+	}
+	dir, err := trickplayDir(p)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	http.ServeFile(w, r, filepath.Join(dir, fmt.Sprintf("sheet_%03d.jpg", sheet)))
+}
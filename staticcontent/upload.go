@@ -0,0 +1,380 @@
+package staticcontent
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+var max_upload_size = flag.Int64("max_upload_size", 8<<30,
+	"Largest file (in bytes) that may be uploaded into a writable root.")
+var upload_retention = flag.Duration("upload_retention", 24*time.Hour,
+	"How long an abandoned partial upload is kept (since its last chunk) "+
+		"before being purged. If 0, partial uploads are kept until finished.")
+
+var (
+	// Uploads files into a directory of a writable root: a multipart POST of
+	// one or more "file" fields.
+	MODE_UPLOAD = "upload"
+	// Resumable uploads: each POST body is written at PARAM_OFFSET of the
+	// file PARAM_NAME, which is PARAM_SIZE bytes in total, and the file is
+	// moved into place once complete. The client picks a PARAM_UPLOAD_ID
+	// for each upload and sends it with every chunk.
+	MODE_UPLOAD_CHUNK = "upload_chunk"
+	// Reports how much of a resumable upload the server has, as JSON.
+	MODE_UPLOAD_STATUS = "upload_status"
+
+	PARAM_NAME      = "sc_name"
+	PARAM_OFFSET    = "sc_offset"
+	PARAM_SIZE      = "sc_size"
+	PARAM_UPLOAD_ID = "sc_upload_id"
+
+	// What to do when an uploaded file already exists: CONFLICT_RENAME (the
+	// default) saves it under a new name, CONFLICT_OVERWRITE replaces the
+	// existing file and CONFLICT_SKIP keeps it and discards the upload.
+	PARAM_CONFLICT     = "sc_conflict"
+	CONFLICT_RENAME    = "rename"
+	CONFLICT_OVERWRITE = "overwrite"
+	CONFLICT_SKIP      = "skip"
+)
+
+// Prefix of the names of partially uploaded files.
+var partialUploadPrefix = ".webcmd-upload-"
+
+// The result of an upload, as reported to the client.
+type UploadResult struct {
+	Name    string `json:"name"`              // Name the file was saved as
+	Offset  int64  `json:"offset"`            // Bytes received so far
+	Done    bool   `json:"done"`              // Whether the file is in place
+	Skipped bool   `json:"skipped,omitempty"` // Whether a conflict discarded it
+}
+
+// Names of devices, which Windows opens instead of files by that name (with
+// any extension).
+var windowsDeviceNames = map[string]bool{
+	"con": true, "prn": true, "aux": true, "nul": true,
+	"com1": true, "com2": true, "com3": true, "com4": true, "com5": true,
+	"com6": true, "com7": true, "com8": true, "com9": true,
+	"lpt1": true, "lpt2": true, "lpt3": true, "lpt4": true, "lpt5": true,
+	"lpt6": true, "lpt7": true, "lpt8": true, "lpt9": true,
+}
+
+// Checks a new file name is a plain name within the target directory, and not
+// one reserved for our own files. Names Windows can't store as given are
+// refused on every platform, so roots stay usable from it: ones with
+// characters like ':' (which names an alternate data stream) or '?', device
+// names like CON, and trailing dots or spaces, which it drops.
+func validName(name string) error {
+	if len(name) == 0 || name == "." || name == ".." ||
+		strings.ContainsAny(name, `/\`) || filepath.Base(name) != name {
+		return errors.New("Invalid file name: " + name)
+	}
+	device := strings.ToLower(strings.SplitN(name, ".", 2)[0])
+	if strings.ContainsAny(name, `<>:"|?*`) || strings.IndexFunc(name, unicode.IsControl) >= 0 ||
+		strings.HasSuffix(name, ".") || strings.HasSuffix(name, " ") ||
+		windowsDeviceNames[strings.TrimRight(device, " ")] {
+		return errors.New("Invalid file name on Windows: " + name)
+	}
+	if isInternalName(name) {
+		return errors.New("Reserved file name: " + name)
+	}
+	return nil
+}
+
+// Returns the directory of a writable root that r uploads into.
+func (f *FileHandler) uploadDir(r *http.Request) (string, error) {
+	if !f.Options.Writable {
+		return "", errReadOnly
+	}
+	dir, err := f.localPath(r)
+	if err != nil {
+		return "", err
+	}
+	if stat, err := os.Stat(dir); err != nil || !stat.IsDir() {
+		return "", errors.New("Uploads must target a directory.")
+	}
+	return dir, nil
+}
+
+// Returns name, or if that's taken in dir, the first free name like
+// "name (1).ext".
+func freeName(dir string, name string) string {
+	if _, err := os.Lstat(filepath.Join(dir, name)); os.IsNotExist(err) {
+		return name
+	}
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for i := 1; ; i++ {
+		candidate := fmt.Sprintf("%v (%v)%v", base, i, ext)
+		if _, err := os.Lstat(filepath.Join(dir, candidate)); os.IsNotExist(err) {
+			return candidate
+		}
+	}
+}
+
+// Moves the finished upload at tmp to name in dir, resolving conflicts with an
+// existing file as the request asks.
+func placeUpload(tmp string, dir string, name string, conflict string) (UploadResult, error) {
+	result := UploadResult{Name: name, Done: true}
+	target := filepath.Join(dir, name)
+	if _, err := os.Lstat(target); err == nil {
+		switch conflict {
+		case CONFLICT_OVERWRITE:
+		case CONFLICT_SKIP:
+			result.Skipped = true
+			return result, os.Remove(tmp)
+		default:
+			result.Name = freeName(dir, name)
+			target = filepath.Join(dir, result.Name)
+		}
+	}
+	log.Println("Saving upload as", target)
+	return result, os.Rename(tmp, target)
+}
+
+// Handler for multipart uploads of one or more files into the requested
+// directory. Responds with a JSON list of UploadResults. Parameters must be
+// in the URL, since the body is streamed straight to disk.
+func (f *FileHandler) ServeUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Uploads must be POSTed.", http.StatusMethodNotAllowed)
+		return
+	}
+	if !SameOrigin(r) {
+		http.Error(w, errCrossSite.Error(), http.StatusForbidden)
+		return
+	}
+	dir, err := f.uploadDir(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	reader, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	conflict := r.URL.Query().Get(PARAM_CONFLICT)
+
+	results := []UploadResult{}
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(part.FileName()) == 0 {
+			continue
+		}
+		name := filepath.Base(filepath.FromSlash(part.FileName()))
+		if err := validName(name); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		tmp, err := ioutil.TempFile(dir, partialUploadPrefix)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		n, err := io.Copy(tmp, io.LimitReader(part, *max_upload_size+1))
+		tmp.Chmod(0644)
+		tmp.Close()
+		if err == nil && n > *max_upload_size {
+			err = errors.New("File too large.")
+		}
+		if err != nil {
+			os.Remove(tmp.Name())
+			http.Error(w, fmt.Sprint("Upload of ", name, " failed: ", err),
+				http.StatusBadRequest)
+			return
+		}
+		result, err := placeUpload(tmp.Name(), dir, name, conflict)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		result.Offset = n
+		results = append(results, result)
+	}
+	writeJSON(w, results)
+}
+
+// Returns the path partial data for the resumable upload id of name with the
+// given total size is kept at, so a retried upload finds it again. Different
+// uploads of files with the same name and size don't share data.
+func partialUploadPath(dir string, id string, name string, size int64) string {
+	key := sha1.Sum([]byte(fmt.Sprintf("%v|%v|%v", id, name, size)))
+	return filepath.Join(dir, fmt.Sprintf("%v%x", partialUploadPrefix, key))
+}
+
+// Checks an upload id is 1-64 letters, digits, '-' or '_'.
+func validUploadId(id string) bool {
+	if len(id) == 0 || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+			c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// Reads the path of the partial data, name and total size of a resumable
+// upload into dir from r.
+func chunkParams(dir string, r *http.Request) (string, string, int64, error) {
+	query := r.URL.Query()
+	id := query.Get(PARAM_UPLOAD_ID)
+	if !validUploadId(id) {
+		return "", "", 0, errors.New("Invalid upload id.")
+	}
+	name := query.Get(PARAM_NAME)
+	if err := validName(name); err != nil {
+		return "", "", 0, err
+	}
+	size, err := strconv.ParseInt(query.Get(PARAM_SIZE), 10, 64)
+	if err != nil || size < 0 {
+		return "", "", 0, errors.New("Invalid upload size.")
+	}
+	if size > *max_upload_size {
+		return "", "", 0, errors.New("File too large.")
+	}
+	return partialUploadPath(dir, id, name, size), name, size, nil
+}
+
+// Handler reporting how many bytes of a resumable upload have been received,
+// so an interrupted upload can continue from there.
+func (f *FileHandler) ServeUploadStatus(w http.ResponseWriter, r *http.Request) {
+	dir, err := f.uploadDir(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	partial, name, _, err := chunkParams(dir, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	result := UploadResult{Name: name}
+	if stat, err := os.Stat(partial); err == nil {
+		result.Offset = stat.Size()
+	}
+	writeJSON(w, result)
+}
+
+// Handler for one chunk of a resumable upload. Chunks must arrive in order;
+// one at the wrong offset is rejected with the offset the server expects.
+func (f *FileHandler) ServeUploadChunk(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Uploads must be POSTed.", http.StatusMethodNotAllowed)
+		return
+	}
+	if !SameOrigin(r) {
+		http.Error(w, errCrossSite.Error(), http.StatusForbidden)
+		return
+	}
+	dir, err := f.uploadDir(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	partial, name, size, err := chunkParams(dir, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	offset, err := strconv.ParseInt(r.URL.Query().Get(PARAM_OFFSET), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid upload offset.", http.StatusBadRequest)
+		return
+	}
+
+	file, err := os.OpenFile(partial, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	stat, err := file.Stat()
+	if err != nil || stat.Size() != offset {
+		file.Close()
+		result := UploadResult{Name: name}
+		if err == nil {
+			result.Offset = stat.Size()
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(result)
+		return
+	}
+	file.Seek(offset, io.SeekStart)
+	n, err := io.Copy(file, io.LimitReader(r.Body, size-offset))
+	file.Close()
+	result := UploadResult{Name: name, Offset: offset + n}
+	if err != nil {
+		log.Println("Upload chunk for", name, "interrupted:", err)
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(result)
+		return
+	}
+	if result.Offset == size {
+		placed, err := placeUpload(partial, dir, name, r.URL.Query().Get(PARAM_CONFLICT))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		placed.Offset = size
+		result = placed
+	}
+	writeJSON(w, result)
+}
+
+// Removes partial uploads last written to more than --upload_retention ago
+// from all writable roots.
+func (server *Server) PurgeUploads() {
+	if *upload_retention <= 0 {
+		return
+	}
+	for _, f := range server.handlers {
+		if !f.Options.Writable {
+			continue
+		}
+		filepath.Walk(f.OSPath, func(p string, info os.FileInfo, err error) error {
+			if err != nil {
+				return nil
+			}
+			if info.IsDir() && info.Name() == trashDirName {
+				return filepath.SkipDir
+			}
+			if !info.IsDir() && strings.HasPrefix(info.Name(), partialUploadPrefix) &&
+				time.Since(info.ModTime()) > *upload_retention {
+				log.Println("Purging abandoned upload", p)
+				if err := os.Remove(p); err != nil {
+					log.Println("Unable to purge upload:", err)
+				}
+			}
+			return nil
+		})
+	}
+}
+
+// Writes v to w as JSON.
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,44 @@
+package staticcontent
+
+import (
+	"testing"
+)
+
+func TestValidName(t *testing.T) {
+	tests := []struct {
+		name string
+		ok   bool
+	}{
+		{"photo.jpg", true},
+		{"My Movie (2012).mkv", true},
+		{".bashrc", true},
+		{"CONSOLE.txt", true},
+		{"com10", true},
+		{"", false},
+		{".", false},
+		{"..", false},
+		{"a/b", false},
+		{`a\b`, false},
+		{"a:b", false},
+		{"notes.txt:hidden", false},
+		{"what?", false},
+		{"a*b", false},
+		{`"quoted"`, false},
+		{"a<b>", false},
+		{"pipe|d", false},
+		{"tab\there", false},
+		{"CON", false},
+		{"con.txt", false},
+		{"Lpt1.log", false},
+		{"nul .txt", false},
+		{"trailing.", false},
+		{"trailing ", false},
+		{trashDirName, false},
+		{partialUploadPrefix + "x", false},
+	}
+	for _, test := range tests {
+		if err := validName(test.name); (err == nil) != test.ok {
+			t.Errorf("validName(%q) = %v; want ok=%v", test.name, err, test.ok)
+		}
+	}
+}